@@ -1,19 +1,39 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	_ "time/tzdata" // the alpine base image doesn't ship a zoneinfo database
+	"unicode/utf8"
 
 	"github.com/IBM/cloudant-go-sdk/cloudantv1"
 )
@@ -24,6 +44,8 @@ type RssFeed struct {
 	RssFeedUrl      string `json:"RSS_Feed_URL"`
 	LastUpdatedDate string `json:"Last_Updated_Date"`
 	Magazine        string `json:"Magazine"`
+	PauseReason     string `json:"Pause_Reason"`
+	CreatedDate     string `json:"Created_Date"`
 }
 
 type Feed struct {
@@ -31,6 +53,9 @@ type Feed struct {
 	FeedUrl         string `json:"feed_url"`
 	LastUpdatedDate string `json:"last_updated_date"`
 	FeedName        string `json:"feed_name"`
+	PauseReason     string `json:"pause_reason"`
+	CreatedDate     string `json:"created_date"`
+	DisplayName     string `json:"display_name,omitempty"`
 }
 
 type DBRow struct {
@@ -44,9 +69,13 @@ type DBRow struct {
 	SentimentScore   float32 `json:"sentiment_score"`
 }
 
-type MagazineData struct {
+type FeedResult struct {
 	Magazine         string
+	Publisher        string
 	IngestedArticles int
+	Articles         []DBRow // only kept in report_detail mode
+	Attempts         int
+	Err              error
 }
 
 type DBQuery struct {
@@ -70,237 +99,4417 @@ type BrevoAttachment struct {
 }
 
 type BrevoQuery struct {
-	Sender      BrevoSender       `json:"sender"`
-	To          []BrevoTo         `json:"to"`
-	Subject     string            `json:"subject"`
-	HtmlContent string            `json:"htmlContent"`
-	Attachment  []BrevoAttachment `json:"attachment"`
+	Sender      BrevoSender            `json:"sender"`
+	To          []BrevoTo              `json:"to"`
+	Cc          []BrevoTo              `json:"cc,omitempty"`
+	Bcc         []BrevoTo              `json:"bcc,omitempty"`
+	Subject     string                 `json:"subject"`
+	HtmlContent string                 `json:"htmlContent,omitempty"`
+	TemplateId  int                    `json:"templateId,omitempty"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	Attachment  []BrevoAttachment      `json:"attachment,omitempty"`
+	Headers     map[string]string      `json:"headers,omitempty"`
 }
 
+// RunSummary is printed as JSON at the end of the run for monitoring
+type RunSummary struct {
+	RunID           string    `json:"run_id"`
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	IngestDate      string    `json:"ingest_date"`
+	IngestStart     string    `json:"ingest_start,omitempty"` // RFC3339
+	IngestEnd       string    `json:"ingest_end,omitempty"`   // RFC3339
+	TotalFeeds      int       `json:"total_feeds"`
+	TotalMagazines  int       `json:"total_magazines"`
+	TotalArticles   int       `json:"total_articles"`
+	ZeroIngestion   int       `json:"zero_ingestion_magazines"`
+	ZeroPercent     float64   `json:"zero_ingestion_percent"`
+	FailedFeeds     int       `json:"failed_feeds"`
+	ReportURLs      []string  `json:"report_urls,omitempty"`
+	Error           string    `json:"error,omitempty"` // why the run failed, if it did
+}
+
+// Report is everything that goes into the CSV attachment
+type Report struct {
+	MagData            map[string]int    // magazine -> ingested articles
+	Keys               []string          // magazines in report order
+	Publishers         map[string]string // magazine -> publisher
+	Attempts           map[string]int    // nil to leave out the attempts column
+	StaleFeeds         []StaleFeed
+	UnhealthyFeeds     []FeedStatus
+	BelowExpected      []BelowExpected
+	BaselineDrops      []BaselineDrop
+	PersistentFailures []PersistentFailure
+	MalformedDocs      []MalformedDoc
+	GroupByPublisher   bool
+	BOM                bool // prepend a UTF-8 BOM so Excel detects the encoding
+	Delimiter          rune
+}
+
+type ReportData struct {
+	ProgramName    string
+	RunDate        string
+	TotalMagazines int
+	TotalArticles  int
+	ZeroIngestion  int
+	ZeroPercent    float64 // percentage of magazines with no articles
+	FailedFeeds    int
+	StaleFeeds     int
+	UnhealthyFeeds int
+	ZeroSuppressed bool             // zero ingestion is expected today, so isn't flagged
+	ZeroInGrace    int              // zero-ingestion magazines too new to flag
+	Magazines      []ReportMagazine // in report order, for body templates
+	Publishers     []PublisherGroup // Magazines by publisher, if group_by_publisher is set
+}
+
+type ReportMagazine struct {
+	Name      string
+	Publisher string
+	Articles  int
+	Link      string // HTML for the name, linked to dashboard_url_template if set
+}
+
+// PublisherGroup is one publisher's magazines in the report, in report order
+type PublisherGroup struct {
+	Name      string
+	Subtotal  int
+	Magazines []ReportMagazine
+}
+
+type StaleFeed struct {
+	FeedName        string
+	Publisher       string
+	LastUpdatedDate string
+	AgeDays         int // -1 if LastUpdatedDate couldn't be parsed
+}
+
+type BelowExpected struct {
+	Magazine    string
+	Articles    int
+	MinArticles int
+}
+
+type PersistentFailure struct {
+	Magazine      string
+	FailureStreak int    // consecutive runs the DB lookup has failed
+	LastSuccess   string // RFC3339, empty if it's never succeeded
+}
+
+type BaselineDrop struct {
+	Magazine    string
+	Articles    int
+	BaselineAvg float32 // average daily articles over the baseline window
+}
+
+type FeedStatus struct {
+	FeedName   string
+	FeedUrl    string
+	StatusCode int
+	IsXML      bool
+	Err        error
+}
+
+// How long to wait on any one feed URL before giving up on it
+const feedCheckTimeout = 10 * time.Second
+
+// Layouts we've seen Last_Updated_Date stored as in Cloudant
+var feedDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006-1-2",
+}
+
+// Shared by every outbound call so connections to the DB get reused
+// across the parallel lookups instead of each doing its own TLS handshake
+var httpClient = NewHTTPClient()
+
+// Counters and gauges for the run, served on metrics_port and/or pushed to
+// pushgateway_url if either is set
+var metrics = NewMetrics()
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Identifies this run in the logs, the summary and the emails we send
+var runID = NewRunID()
+
+const defaultReportSubjectTemplate = `{{.ProgramName}} Feed Health Status — {{thousands .TotalArticles}} articles, {{printf "%.0f" .ZeroPercent}}% with no articles`
+const defaultAttachmentNameTemplate = "daily_article_data_{{.RunDate}}"
+const defaultReportBodyTemplate = "<html><head></head><body>" + seeAttachedText + "</body></html>"
+
+// seeAttachedText points at the attachment in the default body, and is
+// dropped when the report isn't attached
+const seeAttachedText = "See attached for the total ingested articles in the past 24 hours by magazine."
+
 func main() {
 
+	// Cancel everything in-flight if we're told to stop (e.g. during a deploy)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Optionally serve liveness/readiness checks for the platform
+	var ready atomic.Bool
+	var healthServer *http.Server
+	if port := os.Getenv("serve_health_port"); port != "" {
+		healthServer = StartHealthServer(port, &ready)
+	}
+	if port := os.Getenv("metrics_port"); port != "" {
+		StartMetricsServer(port, metrics)
+	}
+
 	// Get the namespace we're in so we know how to talk to the Function
 	file := "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 	namespace, err := ioutil.ReadFile(file)
 	if err != nil || len(namespace) == 0 {
-		fmt.Fprintf(os.Stderr, "Missing namespace: %s\n%s\n", err, namespace)
+		logErrorf("Missing namespace: %s\n%s\n", err, namespace)
 		os.Exit(1)
 	}
 
-	// Query Cloudant for the feed list
-	// selector= {"_id": {"$gt": "0"},"Publisher_Name": {"$exists": True},"RSS_Feeds": {"$exists": True}},
-	service, err := cloudantv1.NewCloudantV1UsingExternalConfig(
-		&cloudantv1.CloudantV1Options{},
-	)
+	// Catch misconfigured URLs before we do any work
+	config, err := validateConfig()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing Cloudant Service: %s", err)
-		os.Exit(1)
+		logErrorf("Invalid config: %s\n", err)
+		_, code := ErrorCategory(err)
+		os.Exit(code)
 	}
+	ready.Store(true)
 
-	selector := map[string]interface{}{
-		"_id": map[string]interface{}{
-			"$gt": "0",
-		},
-		"Publisher_Name": map[string]interface{}{
-			"$exists": true,
-		},
-		"RSS_Feeds": map[string]interface{}{
-			"$exists": true,
-		},
+	// Just smoke test the dependencies, if asked for
+	if os.Getenv("validate_only") == "true" {
+		if !Validate(ctx, ValidationChecks(config)) {
+			os.Exit(1)
+		}
+		return
 	}
-	dbName := os.Getenv("db_name")
-	queryOptions := &cloudantv1.PostFindOptions{
-		Db:       &dbName,
-		Selector: selector,
+
+	// Run once and exit, or keep running on an internal schedule
+	if schedule := os.Getenv("schedule_cron"); schedule != "" {
+		cron, err := ParseCron(schedule)
+		if err != nil {
+			logErrorf("Invalid schedule_cron %q: %s\n", schedule, err)
+			_, code := ErrorCategory(&ConfigError{Err: err})
+			os.Exit(code)
+		}
+		clock := realClock{Loc: LoadReportLocation(os.Getenv("report_timezone"))}
+		RunScheduled(ctx, cron, clock, func(ctx context.Context) error {
+			return runWithAlert(ctx, config)
+		})
+	} else if err := runWithAlert(ctx, config); err != nil {
+		category, code := ErrorCategory(err)
+		logErrorf("category=%s %s\n", category, err)
+		os.Exit(code)
 	}
 
-	// Execute the query
-	findResult, _, err := service.PostFind(queryOptions)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error Finding All Documents using Cloudant Service: %s", err)
-		os.Exit(1)
+	// RunScheduled only returns once we're told to stop, and a one-shot run
+	// is done, so stop serving health checks either way
+	if healthServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := healthServer.Shutdown(shutdownCtx); err != nil {
+			logErrorf("Error shutting down health server: %s\n", err)
+		}
 	}
+}
 
-	// Parse Result from Cloudant to build slice of RSS Feeds
-	var feeds []Feed
-	for _, doc := range findResult.Docs {
-		var rssFeeds []RssFeed
-		b, err := json.Marshal(doc.GetProperty("RSS_Feeds"))
+// run does one health check: load the feeds, count what the DB ingested for
+// each and send the report
+func run(ctx context.Context, config *Config) (runErr error) {
+	runID = NewRunID()
+	summary := RunSummary{RunID: runID, StartTime: time.Now().UTC()}
+	logf("program=%q Starting health check\n", ProgramName())
+
+	// Always finish with the summary, so a failed run still reports one
+	if os.Getenv("emit_summary") == "true" {
+		defer func() {
+			if runErr != nil {
+				summary.Error = runErr.Error()
+			}
+			summary.EndTime = time.Now().UTC()
+			summary.DurationSeconds = summary.EndTime.Sub(summary.StartTime).Seconds()
+			summaryJson, err := json.Marshal(summary)
+			if err != nil {
+				logErrorf("Error encoding run summary: %s\n", err)
+				return
+			}
+			fmt.Println(string(summaryJson))
+		}()
+	}
+
+	// Load the feed list, from a local file if one is configured,
+	// otherwise from Cloudant
+	phaseStart := time.Now()
+
+	// Only connect to Cloudant if something needs it
+	var service *cloudantv1.CloudantV1
+	cloudantService := func() (*cloudantv1.CloudantV1, error) {
+		if service == nil {
+			svc, err := cloudantv1.NewCloudantV1UsingExternalConfig(
+				&cloudantv1.CloudantV1Options{},
+			)
+			if err != nil {
+				return nil, &CloudantError{Err: fmt.Errorf("error initializing Cloudant Service: %s", err)}
+			}
+			service = svc
+		}
+		return service, nil
+	}
+
+	var store FeedStore
+	if feedsFile := os.Getenv("feeds_file"); feedsFile != "" {
+		store = &FileFeedStore{Path: feedsFile}
+	} else {
+		maxRetries, err := strconv.Atoi(GetEnvDefault("cloudant_max_retries", "5"))
+		if err != nil || maxRetries < 1 {
+			return configErrorf("invalid cloudant_max_retries: %q", os.Getenv("cloudant_max_retries"))
+		}
+		selector, err := FeedSelector(os.Getenv("publisher_filter"), os.Getenv("cloudant_selector_json"))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error Marshaling RSS_Feeds interface into JSON: %s", err)
-			os.Exit(1)
+			return configErrorf("invalid cloudant_selector_json: %s", err)
 		}
-		err = json.Unmarshal(b, &rssFeeds)
+		pageLimit, err := strconv.ParseInt(GetEnvDefault("cloudant_page_limit", "200"), 10, 64)
+		if err != nil || pageLimit < 1 {
+			return configErrorf("invalid cloudant_page_limit: %q", os.Getenv("cloudant_page_limit"))
+		}
+		timeoutSeconds, err := strconv.Atoi(GetEnvDefault("cloudant_timeout_seconds", "60"))
+		if err != nil || timeoutSeconds < 1 {
+			return configErrorf("invalid cloudant_timeout_seconds: %q", os.Getenv("cloudant_timeout_seconds"))
+		}
+		if os.Getenv("debug") == "true" {
+			selectorJson, _ := json.Marshal(selector)
+			logf("Cloudant selector: %s\n", selectorJson)
+		}
+		service, err := cloudantService()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error Decoding JSON: %s", err)
-			os.Exit(1)
+			return err
 		}
-		for _, rssfeed := range rssFeeds {
-			feed := Feed{
-				Publisher:       doc.GetProperty("Publisher_Name").(string),
-				FeedUrl:         rssfeed.RssFeedUrl,
-				FeedName:        rssfeed.RssFeedName,
-				LastUpdatedDate: rssfeed.LastUpdatedDate,
-			}
-			feeds = append(feeds, feed)
+		store = &RetryFeedStore{
+			Store: &CloudantFeedStore{
+				Service:   service,
+				DbName:    os.Getenv("db_name"),
+				Selector:  selector,
+				PageLimit: pageLimit,
+				Timeout:   time.Duration(timeoutSeconds) * time.Second,
+			},
+			MaxRetries: maxRetries,
+			Delay:      time.Second,
+		}
+	}
+
+	feeds, err := store.GetFeeds(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading feeds: %w", err)
+	}
+	var malformedDocs []MalformedDoc
+	if m, ok := store.(MalformedReporter); ok {
+		malformedDocs = m.MalformedDocs()
+	}
+	if len(malformedDocs) > 0 {
+		ids := make([]string, 0, len(malformedDocs))
+		for _, doc := range malformedDocs {
+			ids = append(ids, doc.DocID)
+		}
+		logErrorf("Warning: skipped %d malformed feed documents: %s\n", len(malformedDocs), strings.Join(ids, ", "))
+	}
+	feeds, err = NormalizeFeeds(feeds, os.Getenv("feed_name_case"))
+	if err != nil {
+		return err
+	}
+	feeds, dupes := DedupeFeeds(feeds)
+	if dupes > 0 {
+		logf("Dropped %d duplicate feeds\n", dupes)
+	}
+	feeds, skipped := SkipFeeds(feeds, SplitList(os.Getenv("skip_feeds")), SplitList(os.Getenv("skip_publishers")))
+	if skipped > 0 {
+		logf("Skipped %d feeds by name or publisher\n", skipped)
+	}
+	// Only recheck the feeds that failed last time, if asked to
+	var retryData *FailedFeedsData
+	if retryFrom := os.Getenv("retry_failed_from"); retryFrom != "" {
+		retryData, err = LoadFailedFeeds(retryFrom)
+		if err != nil {
+			return fmt.Errorf("error loading retry_failed_from: %s", err)
 		}
+		feeds = OnlyFeeds(feeds, retryData.Magazines)
+		logf("Rerunning %d failed feeds from run %s\n", len(feeds), retryData.RunID)
 	}
+	logPhase("load_feeds", phaseStart)
 
 	count := len(feeds)
-	fmt.Printf("Getting articles ingested for %d feeds...\n", count)
+	logf("Getting articles ingested for %d feeds...\n", count)
 	wg := sync.WaitGroup{}
 
-	// URL to the DB
-	baseDBURL := os.Getenv("sql_db_url") + "v2/get-article-by-ingestdate-magazine"
+	// Serve canned DB responses from a fixture file for offline runs
+	dbClient := httpClient
+	// Present a client certificate to the DB, if it wants mutual TLS
+	cert, err := LoadDBClientCert()
+	if err != nil {
+		return configErrorf("invalid db_client_cert/db_client_key: %s", err)
+	}
+	if cert != nil {
+		dbClient = WithClientCert(dbClient, cert)
+	}
+	dbURLs := config.DBURLs
+	if fixtureFile := os.Getenv("db_fixture_json"); fixtureFile != "" {
+		fixture, err := LoadDBFixture(fixtureFile)
+		if err != nil {
+			return fmt.Errorf("error loading db_fixture_json: %s", err)
+		}
+		logf("Using DB fixture %s for %d magazines\n", fixtureFile, len(fixture.Counts))
+		dbClient = &http.Client{Transport: fixture}
+		if len(dbURLs) == 0 {
+			dbURLs = []string{"http://fixture"}
+		}
+	}
+
+	dbClient = WithDBAuth(dbClient)
+
+	// URL(s) to the DB; with more than one, every feed is looked up in each
+	var baseDBURLs []string
+	for _, dbURL := range dbURLs {
+		baseDBURLs = append(baseDBURLs, joinURL(dbURL, GetEnvDefault("db_article_path", "v2/get-article-by-ingestdate-magazine")))
+	}
+	combineMode := GetEnvDefault("db_combine_mode", "sum")
+	if combineMode != "sum" && combineMode != "max" {
+		return configErrorf("invalid db_combine_mode: %q", combineMode)
+	}
+	// How to count a lookup's articles: the rows returned, or a total the
+	// DB reports alongside them
+	countMode := GetEnvDefault("db_count_mode", "rows")
+	if countMode != "rows" && countMode != "field" {
+		return configErrorf("invalid db_count_mode: %q", countMode)
+	}
+	discrepancyThreshold, err := strconv.Atoi(GetEnvDefault("db_discrepancy_threshold", "0"))
+	if err != nil || discrepancyThreshold < 0 {
+		return configErrorf("invalid db_discrepancy_threshold: %q", os.Getenv("db_discrepancy_threshold"))
+	}
+
+	// All dates are computed and displayed in the report timezone
+	loc := LoadReportLocation(os.Getenv("report_timezone"))
+
+	ingestDate := DefaultIngestDate(time.Now(), loc)
+
+	// Allow backfilling the report for a specific day
+	if override := os.Getenv("ingest_date"); override != "" {
+		ingestDate, err = time.ParseInLocation("2006-01-02", override, loc)
+		if err != nil {
+			return configErrorf("invalid ingest_date %q: %s", override, err)
+		}
+	} else if retryData != nil {
+		// A rerun is for the same day as the run that failed
+		ingestDate, err = time.ParseInLocation("2006-01-02", retryData.IngestDate, loc)
+		if err != nil {
+			return configErrorf("invalid ingest_date %q in retry_failed_from: %s", retryData.IngestDate, err)
+		}
+	}
+	logf("Using ingest date %s\n", ingestDate.Format("2006-01-02"))
+	summary.IngestDate = ingestDate.Format("2006-1-2")
+
+	// Optionally pass the DB an explicit window instead of just the date: the
+	// window up to now, or from the start of a backfilled or rerun day
+	useRange := os.Getenv("db_use_range") == "true"
+	window, err := time.ParseDuration(GetEnvDefault("ingest_window", "24h"))
+	if err != nil || window <= 0 {
+		return configErrorf("invalid ingest_window: %q", os.Getenv("ingest_window"))
+	}
+	rangeEnd := time.Now().In(loc)
+	if os.Getenv("ingest_date") != "" || retryData != nil {
+		rangeEnd = ingestDate.Add(window)
+	}
+	rangeStart := rangeEnd.Add(-window)
+	if useRange {
+		logf("Using ingest window %s to %s\n", rangeStart.Format(time.RFC3339), rangeEnd.Format(time.RFC3339))
+		summary.IngestStart = rangeStart.Format(time.RFC3339)
+		summary.IngestEnd = rangeEnd.Format(time.RFC3339)
+	} else {
+		dayStart := time.Date(ingestDate.Year(), ingestDate.Month(), ingestDate.Day(), 0, 0, 0, 0, loc)
+		summary.IngestStart = dayStart.Format(time.RFC3339)
+		summary.IngestEnd = dayStart.AddDate(0, 0, 1).Format(time.RFC3339)
+	}
+	summary.TotalFeeds = count
+
+	// Limit how many outbound requests we have in flight at once
+	maxConcurrency, err := strconv.Atoi(GetEnvDefault("max_concurrency", "50"))
+	if err != nil || maxConcurrency < 1 {
+		return configErrorf("invalid max_concurrency: %q", os.Getenv("max_concurrency"))
+	}
+	sem := make(chan struct{}, maxConcurrency)
+
+	// Keep the articles themselves for a detailed report, if asked for
+	reportDetail := os.Getenv("report_detail") == "true"
+	maxDetailRows, err := strconv.Atoi(GetEnvDefault("report_detail_max_rows", "100"))
+	if err != nil || maxDetailRows < 0 {
+		return configErrorf("invalid report_detail_max_rows: %q", os.Getenv("report_detail_max_rows"))
+	}
 
-	// IngestDate of 24 hours ago
-	toAdd := -24 * time.Hour
-	ingestDate := time.Now().UTC().Add(toAdd)
+	// Stop hammering the DB once it's clearly down, if asked to
+	var breaker *CircuitBreaker
+	if raw := os.Getenv("db_breaker_failures"); raw != "" {
+		failures, err := strconv.Atoi(raw)
+		if err != nil || failures < 1 {
+			return configErrorf("invalid db_breaker_failures: %q", raw)
+		}
+		window, err := time.ParseDuration(GetEnvDefault("db_breaker_window", "1m"))
+		if err != nil {
+			return configErrorf("invalid db_breaker_window: %s", err)
+		}
+		breaker = &CircuitBreaker{Threshold: failures, Window: window}
+	}
 
 	// Create channel to store DB responses
-	magDataCh := make(chan MagazineData, count)
+	magDataCh := make(chan FeedResult, count)
+
+	// Combine what each backend returned for one feed into its result
+	finishResult := func(result *FeedResult, rowsByBackend [][]DBRow, counts []int) {
+		if DBDiscrepancy(counts, discrepancyThreshold) {
+			logErrorf("Warning: DB backends disagree on %q: %v\n", result.Magazine, counts)
+		}
+		dbRes := CombineDBRows(rowsByBackend, combineMode)
+		result.IngestedArticles = CombineCounts(counts, combineMode)
+		if reportDetail {
+			if len(dbRes) > maxDetailRows {
+				dbRes = dbRes[:maxDetailRows]
+			}
+			result.Articles = dbRes
+		}
+	}
+
+	// Look up several magazines per request, if the DB supports it
+	batchSize := 1
+	if os.Getenv("db_supports_batch") == "true" {
+		batchSize, err = strconv.Atoi(GetEnvDefault("db_batch_size", "50"))
+		if err != nil || batchSize < 1 {
+			return configErrorf("invalid db_batch_size: %q", os.Getenv("db_batch_size"))
+		}
+	}
+
+	batchFeeds, singleFeeds := []Feed(nil), feeds
+	if batchSize > 1 {
+		batchFeeds, singleFeeds = SplitBatchable(feeds)
+	}
 
 	// Do all requests to the DB in parallel
-	for i := 0; i < count; i++ {
-		params := url.Values{}
-		params.Add("apikey", os.Getenv("sql_db_apikey"))
-		params.Add("ingestdate", ingestDate.Format("2006-1-2"))
-		params.Add("magazine", feeds[i].FeedName)
-		fullDBURL := baseDBURL + "?" + params.Encode()
+	phaseStart = time.Now()
+	for i := 0; i < len(batchFeeds); i += batchSize {
+		end := i + batchSize
+		if end > len(batchFeeds) {
+			end = len(batchFeeds)
+		}
+		var magazines []string
+		for _, feed := range batchFeeds[i:end] {
+			magazines = append(magazines, feed.FeedName)
+		}
+		params := DBBatchQueryParams(magazines, ingestDate)
+		if useRange {
+			AddIngestRange(params, rangeStart, rangeEnd)
+		}
+		query := params.Encode()
 		wg.Add(1)
-		go func(i int, fullDBURL string, magazine string) {
+		go func(i int, query string, batch []Feed) {
 			defer wg.Done()
-			for j := 0; j < 10; j++ {
-				res, err := http.Get(fullDBURL)
-
-				if err == nil && res.StatusCode/100 == 2 {
-					var dbRes []DBRow
-					err := json.NewDecoder(res.Body).Decode(&dbRes)
-					if err != nil {
-						fmt.Println("JSON decode for DB ROW error!")
-						panic(err)
-					}
-					magData := MagazineData{
-						Magazine:         magazine,
-						IngestedArticles: len(dbRes),
+			results := make([]FeedResult, len(batch))
+			for k, feed := range batch {
+				results[k] = FeedResult{Magazine: feed.Name(), Publisher: feed.Publisher}
+			}
+			defer func() {
+				for _, result := range results {
+					magDataCh <- result
+				}
+			}()
+			failAll := func(err error) {
+				for k := range results {
+					results[k].Err = err
+				}
+			}
+			// Don't let a bug processing one batch take down the whole run
+			defer func() {
+				if r := recover(); r != nil {
+					logErrorf("Recovered from panic fetching batch %d: %v\n", i, r)
+					failAll(fmt.Errorf("panic: %v", r))
+				}
+			}()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				failAll(ctx.Err())
+				return
+			}
+			rowsByBackend := make([][][]DBRow, len(batch))
+			counts := make([][]int, len(batch))
+			for _, baseDBURL := range baseDBURLs {
+				rows, batchCounts, attempts, err := FetchArticleBatch(ctx, dbClient, breaker, countMode, i, baseDBURL+"?"+query)
+				for k := range results {
+					results[k].Attempts += attempts
+				}
+				if err != nil {
+					failAll(err)
+					return
+				}
+				for k, feed := range batch {
+					dbRes, ok := rows[feed.FeedName]
+					if !ok {
+						results[k].Err = &DBError{Err: fmt.Errorf("batch response is missing magazine %q", feed.FeedName)}
+						continue
 					}
-					magDataCh <- magData
-					break
+					rowsByBackend[k] = append(rowsByBackend[k], dbRes)
+					counts[k] = append(counts[k], batchCounts[feed.FeedName])
 				}
-
-				// Something went wrong, pause and try again
-				body := []byte{}
-				if res != nil {
-					body, _ = ioutil.ReadAll(res.Body)
+			}
+			for k := range results {
+				if results[k].Err == nil {
+					finishResult(&results[k], rowsByBackend[k], counts[k])
+				}
+			}
+		}(i, query, batchFeeds[i:end])
+	}
+	for i, feed := range singleFeeds {
+		params := DBQueryParams(feed.FeedName, ingestDate)
+		if useRange {
+			AddIngestRange(params, rangeStart, rangeEnd)
+		}
+		query := params.Encode()
+		wg.Add(1)
+		go func(i int, query string, magazine string, publisher string) {
+			defer wg.Done()
+			result := FeedResult{Magazine: magazine, Publisher: publisher}
+			defer func() { magDataCh <- result }()
+			// Don't let a bug processing one feed take down the whole run
+			defer func() {
+				if r := recover(); r != nil {
+					logErrorf("Recovered from panic fetching %q: %v\n", magazine, r)
+					result.Err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				return
+			}
+			rowsByBackend := make([][]DBRow, 0, len(baseDBURLs))
+			counts := make([]int, 0, len(baseDBURLs))
+			for _, baseDBURL := range baseDBURLs {
+				dbRes, count, attempts, err := FetchArticles(ctx, dbClient, breaker, countMode, i, baseDBURL+"?"+query)
+				result.Attempts += attempts
+				if err != nil {
+					result.Err = err
+					return
 				}
-				fmt.Fprintf(os.Stderr, "%d: err: %s\nhttp res: %#v\nbody:%s",
-					i, err, res, string(body))
-				time.Sleep(time.Second)
+				rowsByBackend = append(rowsByBackend, dbRes)
+				counts = append(counts, count)
 			}
-		}(i, fullDBURL, feeds[i].FeedName)
+			finishResult(&result, rowsByBackend, counts)
+		}(i, query, feed.Name(), feed.Publisher)
 	}
 
 	// Wait for all threads to finish before we exit
 	wg.Wait()
 	close(magDataCh)
+	logPhase("db_fetch", phaseStart)
+	if breaker.Open() {
+		logErrorf("DB unavailable: stopped querying after %d consecutive failures\n", breaker.Threshold)
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("run cancelled while querying the DB: %w", ctx.Err())
+	}
 
 	// Gather Data From Channel
 	allMagData := make(map[string]int)
+	articles := make(map[string][]DBRow)
+	attempts := make(map[string]int)
+	publishers := make(map[string]string)
+	retried := 0
+	var failedMags []string
+	var lastErr error
+	var results []FeedResult
 	for chValue := range magDataCh {
+		results = append(results, chValue)
+		metrics.Add("health_checker_feeds_processed_total", 1)
+		if chValue.Attempts > 1 {
+			retried++
+			metrics.Add("health_checker_db_retries_total", float64(chValue.Attempts-1))
+		}
+		if chValue.Err != nil {
+			metrics.Add("health_checker_failed_feeds_total", 1)
+			failedMags = append(failedMags, chValue.Magazine)
+			lastErr = chValue.Err
+			logErrorf("Feed %q failed after %d attempts: %s\n",
+				chValue.Magazine, chValue.Attempts, chValue.Err)
+			continue
+		}
 		allMagData[chValue.Magazine] = chValue.IngestedArticles
+		metrics.SetMagazine("health_checker_articles_ingested", chValue.Magazine, float64(chValue.IngestedArticles))
+		articles[chValue.Magazine] = chValue.Articles
+		attempts[chValue.Magazine] = chValue.Attempts
+		publishers[chValue.Magazine] = chValue.Publisher
 	}
+	logf("%d feeds needed >1 attempt, %d failed\n", retried, len(failedMags))
 
-	// Sort results before building CSV
-	keys := make([]string, 0, len(allMagData))
-	for key := range allMagData {
-		keys = append(keys, key)
+	// Keep the failures so they can be rerun with retry_failed_from
+	if failedFile := os.Getenv("failed_feeds_file"); failedFile != "" {
+		err = SaveFailedFeeds(failedFile, FailedFeedsData{
+			RunID:      runID,
+			IngestDate: ingestDate.Format("2006-01-02"),
+			Magazines:  failedMags,
+		})
+		if err != nil {
+			logErrorf("Error saving failed feeds: %s\n", err)
+		}
 	}
-	sort.SliceStable(keys, func(i, j int) bool {
-		return allMagData[keys[i]] < allMagData[keys[j]]
-	})
-
-	fileName := "daily_article_data.csv"
 
-	err = BuildCSV(fileName, allMagData, keys)
+	// Lots of failed lookups usually means the DB itself is down, so let ops know
+	threshold, err := strconv.Atoi(GetEnvDefault("db_failure_alert_threshold", "5"))
 	if err != nil {
-		fmt.Printf("Error building csv file: %s", err)
-		panic(err)
+		return configErrorf("invalid db_failure_alert_threshold: %s", err)
+	}
+	if len(failedMags) > threshold {
+		err = SendFailureAlert(ctx, httpClient, failedMags, lastErr)
+		if err != nil {
+			logErrorf("Error sending DB failure alert: %s\n", err)
+		}
 	}
 
-	//Convert CSV file to base64 to attach to email
-	fileBytes, err := os.ReadFile(fileName)
+	// Sort results before building CSV
+	keys, err := sortKeys(allMagData, GetEnvDefault("report_sort", "count_asc"), GetEnvDefault("report_sort_ties", "asc"))
 	if err != nil {
-		fmt.Printf("Error reading csv file: %s", err)
-		panic(err)
+		return configErrorf("invalid report_sort: %s", err)
 	}
-	fileContent := base64.StdEncoding.EncodeToString(fileBytes)
 
-	//Send CSV file in email using brevo
-	todayDate := time.Now()
-	todayString := todayDate.Format("2006-1-2")
-	fileName = "daily_article_data_" + todayString + ".csv"
-	client := &http.Client{}
-	var toList []BrevoTo
-	toList = append(toList, BrevoTo{Email: "david.mullen.085@gmail.com"})
-	toList = append(toList, BrevoTo{Email: os.Getenv("email_address")})
-	var attachmentList []BrevoAttachment
-	attachmentList = append(attachmentList, BrevoAttachment{Content: fileContent, Name: fileName})
-	payload := BrevoQuery{
-		Sender: BrevoSender{
-			Name:  "RSS Mailer",
-			Email: "WM.RSS.mailer@gmail.com",
-		},
-		To:          toList,
-		Subject:     "RSS Feed Health Status",
-		HtmlContent: "<html><head></head><body>See attached for the total ingested articles in the past 24 hours by magazine.</body></html>",
-		Attachment:  attachmentList,
+	// Only include the attempts column if asked for
+	if os.Getenv("csv_include_attempts") != "true" {
+		attempts = nil
 	}
-	payloadJson, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", "https://api.brevo.com/v3/smtp/email", bytes.NewBuffer(payloadJson))
-	if err != nil {
-		fmt.Printf("Error creating HTTP request to Brevo: %s", err)
-		panic(err)
+	// Flag feeds that haven't published in a while, if asked for
+	var staleFeeds []StaleFeed
+	if staleDays := os.Getenv("stale_days"); staleDays != "" {
+		days, err := strconv.Atoi(staleDays)
+		if err != nil {
+			return configErrorf("invalid stale_days: %s", err)
+		}
+		staleFeeds = FindStaleFeeds(feeds, days, time.Now().UTC())
+		logf("%d feeds not updated in the last %d days\n", len(staleFeeds), days)
 	}
-	req.Header.Set("api-key", os.Getenv("brevo_api_key"))
 
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error:", err)
-		panic(err)
+	// Check the feed URLs themselves are up and serving XML, if asked for
+	var unhealthyFeeds []FeedStatus
+	if os.Getenv("check_feed_urls") == "true" {
+		// These go out to publishers' sites, so are limited separately from
+		// the DB lookups to stay polite
+		feedConcurrency, err := strconv.Atoi(GetEnvDefault("feed_check_concurrency", "10"))
+		if err != nil || feedConcurrency < 1 {
+			return configErrorf("invalid feed_check_concurrency: %q", os.Getenv("feed_check_concurrency"))
+		}
+		rps, err := strconv.ParseFloat(GetEnvDefault("feed_check_rps", "0"), 64)
+		if err != nil || rps < 0 {
+			return configErrorf("invalid feed_check_rps: %q", os.Getenv("feed_check_rps"))
+		}
+		hostInterval, err := time.ParseDuration(GetEnvDefault("feed_check_host_interval", "1s"))
+		if err != nil || hostInterval < 0 {
+			return configErrorf("invalid feed_check_host_interval: %q", os.Getenv("feed_check_host_interval"))
+		}
+		feedSem := make(chan struct{}, feedConcurrency)
+		limiter := NewRateLimiter(rps, hostInterval)
+
+		phaseStart = time.Now()
+		for _, status := range CheckFeedURLs(ctx, feeds, feedSem, limiter) {
+			if !status.Healthy() {
+				unhealthyFeeds = append(unhealthyFeeds, status)
+			}
+		}
+		logf("%d feed URLs look unhealthy\n", len(unhealthyFeeds))
+		logPhase("feed_url_check", phaseStart)
 	}
-	defer resp.Body.Close()
 
-	//Remove CSV file
-	err = os.Remove("daily_article_data.csv")
+	// Flag magazines publishing less than we expect of them
+	minArticles := make(map[string]int)
+	if raw := os.Getenv("magazine_min_articles"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &minArticles); err != nil {
+			return configErrorf("invalid magazine_min_articles: %s", err)
+		}
+	}
+	defaultMinArticles, err := strconv.Atoi(GetEnvDefault("min_articles_default", "0"))
 	if err != nil {
-		fmt.Printf("Failed to delete article data file: %s", err)
-		panic(err)
+		return configErrorf("invalid min_articles_default: %s", err)
 	}
+	belowExpected := FindBelowExpected(allMagData, keys, minArticles, defaultMinArticles)
 
-	fmt.Printf("Done\n")
+	// Flag magazines well down on their trailing average, if asked for
+	var baselineDrops []BaselineDrop
+	if raw := os.Getenv("baseline_drop_fraction"); raw != "" {
+		fraction, err := strconv.ParseFloat(raw, 32)
+		if err != nil || fraction <= 0 {
+			return configErrorf("invalid baseline_drop_fraction: %q", raw)
+		}
+		baselineDays, err := strconv.Atoi(GetEnvDefault("baseline_days", "7"))
+		if err != nil || baselineDays < 1 {
+			return configErrorf("invalid baseline_days: %q", os.Getenv("baseline_days"))
+		}
+		minDays, err := strconv.Atoi(GetEnvDefault("baseline_min_days", "3"))
+		if err != nil || minDays < 1 {
+			return configErrorf("invalid baseline_min_days: %q", os.Getenv("baseline_min_days"))
+		}
+		service, err := cloudantService()
+		if err != nil {
+			return err
+		}
+		historyStore := &CloudantHistoryStore{
+			Service: service,
+			DbName:  GetEnvDefault("history_db_name", "health_check_history"),
+		}
+		dates := make([]string, baselineDays)
+		for i := range dates {
+			dates[i] = ingestDate.AddDate(0, 0, -(i + 1)).Format("2006-01-02")
+		}
+		history, err := historyStore.LoadHistory(ctx, dates)
+		if err != nil {
+			logErrorf("Error loading history for the baseline, skipping it: %s\n", err)
+		} else {
+			baselines := BaselineAverages(history, minDays)
+			baselineDrops = FindBaselineDrops(allMagData, keys, baselines, float32(fraction))
+			logf("%d magazines below %.0f%% of their %d-day baseline\n", len(baselineDrops), fraction*100, baselineDays)
+		}
+	}
 
-}
+	// Track how long each feed has been failing, to tell a blip from a real
+	// breakage. A rerun only covers some feeds, so leave the streaks alone.
+	var persistentFails []PersistentFailure
+	if os.Getenv("persist_history") == "true" && retryData == nil {
+		threshold, err := strconv.Atoi(GetEnvDefault("persistent_failure_runs", "3"))
+		if err != nil || threshold < 1 {
+			return configErrorf("invalid persistent_failure_runs: %q", os.Getenv("persistent_failure_runs"))
+		}
+		service, err := cloudantService()
+		if err != nil {
+			return err
+		}
+		historyStore := &CloudantHistoryStore{
+			Service: service,
+			DbName:  GetEnvDefault("history_db_name", "health_check_history"),
+		}
+		streaks, err := historyStore.LoadStreaks(ctx)
+		if err != nil {
+			logErrorf("Error loading failure streaks, skipping them: %s\n", err)
+		} else {
+			streaks = UpdateStreaks(streaks, allMagData, failedMags, time.Now().UTC())
+			if err := historyStore.SaveStreaks(ctx, streaks); err != nil {
+				logErrorf("Error saving failure streaks: %s\n", err)
+			}
+			persistentFails = FindPersistentFailures(streaks, threshold)
+			logf("%d feeds have failed %d or more runs in a row\n", len(persistentFails), threshold)
+		}
+	}
 
-func BuildCSV(fileName string, allMagData map[string]int, keys []string) error {
-	//Build CSV file with article data
-	csvFile, err := os.Create(fileName)
-	defer csvFile.Close()
+	report := Report{
+		MagData:            allMagData,
+		Keys:               keys,
+		Publishers:         publishers,
+		Attempts:           attempts,
+		StaleFeeds:         staleFeeds,
+		UnhealthyFeeds:     unhealthyFeeds,
+		BelowExpected:      belowExpected,
+		BaselineDrops:      baselineDrops,
+		PersistentFailures: persistentFails,
+		MalformedDocs:      malformedDocs,
+		GroupByPublisher:   os.Getenv("group_by_publisher") == "true",
+		BOM:                os.Getenv("csv_bom") == "true",
+		Delimiter:          ',',
+	}
+	if delimiter := os.Getenv("csv_delimiter"); delimiter != "" {
+		if utf8.RuneCountInString(delimiter) != 1 {
+			return configErrorf("invalid csv_delimiter %q: must be a single character", delimiter)
+		}
+		report.Delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	}
+	var csvBuf bytes.Buffer
+	err = BuildCSV(&csvBuf, report)
 	if err != nil {
-		fmt.Printf("failed creating file: %s", err)
-		return err
+		return fmt.Errorf("error building csv file: %s", err)
 	}
+	fileBytes := csvBuf.Bytes()
 
-	w := csv.NewWriter(csvFile)
-	defer w.Flush()
+	// Keep a copy of the CSV on disk, if asked for
+	if outputPath := os.Getenv("output_csv_path"); outputPath != "" {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("error creating directory for output_csv_path: %s", err)
+		}
+		if err := os.WriteFile(outputPath, fileBytes, 0644); err != nil {
+			return fmt.Errorf("error writing output_csv_path: %s", err)
+		}
+		logf("Wrote report CSV to %s\n", outputPath)
+	}
 
-	w.Write([]string{"magazine", "articles"})
-	for _, key := range keys {
-		row := []string{key, strconv.Itoa(allMagData[key])}
-		if err := w.Write(row); err != nil {
-			fmt.Printf("Failed to write magazine to file: %s", err)
-			return err
+	// Swap in a spreadsheet instead of the CSV if asked for
+	fileExt := "csv"
+	switch reportFormat := GetEnvDefault("report_format", "csv"); reportFormat {
+	case "csv":
+	case "xlsx":
+		fileBytes, err = buildXLSX(allMagData, keys)
+		if err != nil {
+			return fmt.Errorf("error building xlsx file: %s", err)
+		}
+		fileExt = "xlsx"
+	case "jsonl":
+		var jsonlBuf bytes.Buffer
+		if err := WriteJSONL(&jsonlBuf, results); err != nil {
+			return fmt.Errorf("error building jsonl file: %s", err)
 		}
+		fileBytes = jsonlBuf.Bytes()
+		fileExt = "jsonl"
+	default:
+		return configErrorf("invalid report_format: %q", reportFormat)
 	}
 
-	return nil
+	// Keep a JSON Lines copy on disk for data pipelines, if asked for
+	if jsonlPath := os.Getenv("jsonl_output_path"); jsonlPath != "" {
+		var jsonlBuf bytes.Buffer
+		if err := WriteJSONL(&jsonlBuf, results); err != nil {
+			return fmt.Errorf("error building jsonl file: %s", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(jsonlPath), 0755); err != nil {
+			return fmt.Errorf("error creating directory for jsonl_output_path: %s", err)
+		}
+		if err := os.WriteFile(jsonlPath, jsonlBuf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("error writing jsonl_output_path: %s", err)
+		}
+		logf("Wrote JSON Lines results to %s\n", jsonlPath)
+	}
+
+	//Send CSV file in email using brevo
+	todayDate := time.Now().In(loc)
+	todayString := todayDate.Format("2006-1-2")
+	reportData := ReportData{
+		ProgramName:    ProgramName(),
+		RunDate:        todayString,
+		TotalMagazines: len(allMagData),
+		StaleFeeds:     len(staleFeeds),
+		UnhealthyFeeds: len(unhealthyFeeds),
+		ZeroPercent:    ZeroIngestionPercent(allMagData),
+		FailedFeeds:    len(failedMags),
+	}
+	for _, articles := range allMagData {
+		reportData.TotalArticles += articles
+		if articles == 0 {
+			reportData.ZeroIngestion++
+		}
+	}
+	summary.TotalMagazines = reportData.TotalMagazines
+	summary.TotalArticles = reportData.TotalArticles
+	summary.ZeroIngestion = reportData.ZeroIngestion
+	summary.ZeroPercent = reportData.ZeroPercent
+	summary.FailedFeeds = reportData.FailedFeeds
+	// Zero ingestion is expected on publisher holidays, so don't flag it then
+	reportData.ZeroSuppressed, err = ZeroAlertSuppressed(SplitList(os.Getenv("suppress_zero_dates")), todayDate)
+	if err != nil {
+		return configErrorf("invalid suppress_zero_dates: %s", err)
+	}
+	if reportData.ZeroSuppressed {
+		logf("Zero-ingestion alerting suppressed for %s\n", todayDate.Format("2006-01-02"))
+	}
+	// Newly onboarded feeds may not have anything ingested yet
+	var newFeeds map[string]bool
+	if raw := os.Getenv("new_feed_grace_days"); raw != "" {
+		graceDays, err := strconv.Atoi(raw)
+		if err != nil || graceDays < 0 {
+			return configErrorf("invalid new_feed_grace_days: %q", raw)
+		}
+		newFeeds = FindNewFeeds(feeds, graceDays, todayDate)
+		for mag := range newFeeds {
+			if articles, ok := allMagData[mag]; ok && articles == 0 {
+				reportData.ZeroInGrace++
+			}
+		}
+		logf("%d zero-ingestion magazines are within the %d-day new feed grace period\n", reportData.ZeroInGrace, graceDays)
+	}
+	dashboardTemplate := os.Getenv("dashboard_url_template")
+	for _, mag := range keys {
+		link, err := MagazineLink(dashboardTemplate, mag)
+		if err != nil {
+			return fmt.Errorf("error rendering dashboard_url_template: %s", err)
+		}
+		reportData.Magazines = append(reportData.Magazines,
+			ReportMagazine{Name: mag, Publisher: publishers[mag], Articles: allMagData[mag], Link: link})
+	}
+	if report.GroupByPublisher {
+		reportData.Publishers = GroupByPublisher(reportData.Magazines)
+	}
+	baseName, err := RenderTemplate("attachment_name",
+		GetEnvDefault("attachment_name_template", defaultAttachmentNameTemplate), reportData)
+	if err != nil {
+		return fmt.Errorf("error rendering attachment name: %s", err)
+	}
+	fileName := SanitizeFileName(baseName) + "." + fileExt
+
+	// Upload the report for consumers that would rather pull it from a
+	// bucket, if asked to
+	if storageURL := os.Getenv("output_storage_url"); storageURL != "" {
+		var uploader Uploader = &S3Uploader{
+			BaseURL:   storageURL,
+			Region:    GetEnvDefault("output_storage_region", "us-east-1"),
+			AccessKey: os.Getenv("output_storage_access_key"),
+			SecretKey: os.Getenv("output_storage_secret_key"),
+			Client:    httpClient,
+		}
+		prefix := "daily_article_data/" + ingestDate.Format("2006-01-02") + "/"
+		objectURL, err := uploader.Upload(ctx, prefix+SanitizeFileName(baseName)+".csv", csvBuf.Bytes(), "text/csv")
+		if err != nil {
+			return fmt.Errorf("error uploading csv to output_storage_url: %s", err)
+		}
+		summary.ReportURLs = append(summary.ReportURLs, objectURL)
+		if fileExt != "csv" {
+			contentType := xlsxMIMEType
+			if fileExt == "jsonl" {
+				contentType = "application/x-ndjson"
+			}
+			objectURL, err := uploader.Upload(ctx, prefix+fileName, fileBytes, contentType)
+			if err != nil {
+				return fmt.Errorf("error uploading %s to output_storage_url: %s", fileExt, err)
+			}
+			summary.ReportURLs = append(summary.ReportURLs, objectURL)
+		}
+		logf("Uploaded report to %s\n", strings.Join(summary.ReportURLs, ", "))
+	}
+
+	// Gzip big CSVs so we stay under Brevo's attachment size limit
+	gzipThreshold, err := strconv.Atoi(GetEnvDefault("gzip_attachment_threshold", "0"))
+	if err != nil {
+		return configErrorf("invalid gzip_attachment_threshold: %s", err)
+	}
+	if fileExt == "csv" || fileExt == "jsonl" {
+		fileBytes, fileName, err = CompressAttachment(fileBytes, fileName, gzipThreshold)
+		if err != nil {
+			return fmt.Errorf("error compressing csv file: %s", err)
+		}
+	}
+	fileContent := base64.StdEncoding.EncodeToString(fileBytes)
+	subject, err := RenderTemplate("report_subject",
+		GetEnvDefault("report_subject_template", defaultReportSubjectTemplate), reportData)
+	if err != nil {
+		return fmt.Errorf("error rendering report subject: %s", err)
+	}
+	if retryData != nil {
+		subject = "Supplemental: " + subject
+	}
+	htmlContent, err := RenderTemplate("report_body",
+		GetEnvDefault("report_body_template", defaultReportBodyTemplate), reportData)
+	if err != nil {
+		return fmt.Errorf("error rendering report body: %s", err)
+	}
+	if report.GroupByPublisher {
+		htmlContent = appendToBody(htmlContent, PublisherTableHTML(reportData.Publishers))
+	} else if dashboardTemplate != "" && os.Getenv("report_body_template") == "" {
+		// The default body has nowhere to show the dashboard links otherwise
+		htmlContent = appendToBody(htmlContent, MagazineTableHTML(reportData.Magazines))
+	}
+	for _, objectURL := range summary.ReportURLs {
+		htmlContent = appendToBody(htmlContent, fmt.Sprintf(`<p>The report is also available at <a href="%s">%s</a></p>`,
+			html.EscapeString(objectURL), html.EscapeString(objectURL)))
+	}
+	// Sum up how the run itself went at the bottom of the report
+	if os.Getenv("report_footer") != "false" {
+		htmlContent = appendToBody(htmlContent, FooterHTML(count, failedMags, runID))
+	}
+	// Skip the attachments on healthy days, if asked to, so the body has to
+	// carry the numbers
+	attachReport := true
+	if os.Getenv("attach_only_on_issues") == "true" {
+		htmlContent = insertIntoBody(htmlContent, SummaryHTML(reportData))
+		attachReport = !reportData.Healthy()
+		if !attachReport {
+			htmlContent = strings.Replace(htmlContent, seeAttachedText, "", 1)
+		}
+	}
+	if os.Getenv("all_clear_email") == "true" {
+		subject, htmlContent = TriageReport(subject, htmlContent, reportData.Healthy())
+	}
+
+	var toList []BrevoTo
+	toList = append(toList, BrevoTo{Email: "david.mullen.085@gmail.com"})
+	toList = append(toList, BrevoTo{Email: os.Getenv("email_address")})
+	var ccList []BrevoTo
+	for _, email := range SplitList(os.Getenv("report_cc")) {
+		ccList = append(ccList, BrevoTo{Email: email})
+	}
+	var bccList []BrevoTo
+	for _, email := range SplitList(os.Getenv("report_bcc")) {
+		bccList = append(bccList, BrevoTo{Email: email})
+	}
+
+	// Let the recipients be managed in Cloudant instead, if asked for
+	if os.Getenv("recipients_from_cloudant") == "true" {
+		service, err := cloudantService()
+		if err != nil {
+			return err
+		}
+		recipientStore := &CloudantRecipientStore{
+			Service: service,
+			DbName:  GetEnvDefault("recipients_db", os.Getenv("db_name")),
+			DocID:   GetEnvDefault("recipients_doc_id", "report_recipients"),
+		}
+		recipients, err := recipientStore.GetRecipients(ctx)
+		if err != nil {
+			return fmt.Errorf("error loading recipients from Cloudant: %w", err)
+		}
+		if recipients == nil {
+			logf("No recipients document %s, using the configured recipients\n", recipientStore.DocID)
+		} else {
+			toList, ccList, bccList = recipients.Lists()
+			logf("Loaded %d to, %d cc and %d bcc recipients from Cloudant\n", len(toList), len(ccList), len(bccList))
+		}
+	}
+	var attachmentList []BrevoAttachment
+	if attachReport {
+		attachmentList = append(attachmentList, BrevoAttachment{Content: fileContent, Name: fileName})
+	}
+	if reportDetail && attachReport {
+		detailBytes, err := BuildDetailCSV(articles, keys, report.Delimiter)
+		if err != nil {
+			return fmt.Errorf("error building detail csv: %s", err)
+		}
+		detailBytes, detailName, err := CompressAttachment(detailBytes,
+			"daily_article_detail_"+todayString+".csv", gzipThreshold)
+		if err != nil {
+			return fmt.Errorf("error compressing detail csv: %s", err)
+		}
+		attachmentList = append(attachmentList, BrevoAttachment{
+			Content: base64.StdEncoding.EncodeToString(detailBytes),
+			Name:    detailName,
+		})
+	}
+
+	// Once a week, also attach the last 7 days side by side from the
+	// persisted history
+	weeklyDay, ok := parseWeekday(GetEnvDefault("weekly_report_day", "Monday"))
+	if !ok {
+		return configErrorf("invalid weekly_report_day: %q", os.Getenv("weekly_report_day"))
+	}
+	if os.Getenv("persist_history") == "true" && todayDate.Weekday() == weeklyDay && attachReport {
+		service, err := cloudantService()
+		if err != nil {
+			return err
+		}
+		historyStore := &CloudantHistoryStore{
+			Service: service,
+			DbName:  GetEnvDefault("history_db_name", "health_check_history"),
+		}
+		trendBytes, err := BuildWeeklyTrend(ctx, historyStore, ingestDate, allMagData, report.Delimiter)
+		if err != nil {
+			logErrorf("Error building weekly trend, skipping it: %s\n", err)
+		} else {
+			attachmentList = append(attachmentList, BrevoAttachment{
+				Content: base64.StdEncoding.EncodeToString(trendBytes),
+				Name:    "weekly_article_trend_" + todayString + ".csv",
+			})
+		}
+	}
+	// Brevo rejects the whole email if the attachments are too big, so fall
+	// back to just the worst magazines rather than lose the report
+	maxAttachmentBytes, err := strconv.Atoi(GetEnvDefault("max_attachment_bytes", "10000000"))
+	if err != nil || maxAttachmentBytes < 0 {
+		return configErrorf("invalid max_attachment_bytes: %q", os.Getenv("max_attachment_bytes"))
+	}
+	if size := AttachmentsSize(attachmentList); maxAttachmentBytes > 0 && size > maxAttachmentBytes {
+		truncateRows, err := strconv.Atoi(GetEnvDefault("attachment_truncate_rows", "500"))
+		if err != nil || truncateRows < 1 {
+			return configErrorf("invalid attachment_truncate_rows: %q", os.Getenv("attachment_truncate_rows"))
+		}
+		logErrorf("Attachments are %d bytes, over the %d byte limit; sending the %d worst magazines only\n",
+			size, maxAttachmentBytes, truncateRows)
+		var truncatedBuf bytes.Buffer
+		if err := BuildCSV(&truncatedBuf, TruncateReport(report, truncateRows)); err != nil {
+			return fmt.Errorf("error building truncated csv file: %s", err)
+		}
+		attachmentList = []BrevoAttachment{{
+			Content: base64.StdEncoding.EncodeToString(truncatedBuf.Bytes()),
+			Name:    SanitizeFileName(baseName) + "_truncated.csv",
+		}}
+		note := fmt.Sprintf("<p><b>The full report was too large to attach, so only the %d magazines with the fewest articles are included.</b></p>", truncateRows)
+		if AttachmentsSize(attachmentList) > maxAttachmentBytes {
+			attachmentList = nil
+			note = "<p><b>The report was too large to attach.</b></p>"
+		}
+		htmlContent = insertIntoBody(htmlContent, note)
+	}
+	payload := BrevoQuery{
+		Sender:      NewBrevoSender(),
+		To:          toList,
+		Cc:          ccList,
+		Bcc:         bccList,
+		Subject:     subject,
+		HtmlContent: htmlContent,
+		Attachment:  attachmentList,
+		Headers:     map[string]string{"X-Run-ID": runID},
+	}
+	// Let Brevo render the body from a template it manages, if asked to
+	if raw := os.Getenv("brevo_template_id"); raw != "" {
+		templateId, err := strconv.Atoi(raw)
+		if err != nil || templateId < 1 {
+			return configErrorf("invalid brevo_template_id: %q", raw)
+		}
+		payload.TemplateId = templateId
+		payload.Params = BrevoTemplateParams(reportData, allMagData, keys, failedMags, newFeeds)
+		payload.HtmlContent = ""
+	}
+	// Keep a copy of today's counts for trending, if asked to. A rerun only
+	// has some of the day's magazines, so it would spoil the history.
+	if os.Getenv("persist_history") == "true" && retryData == nil {
+		service, err := cloudantService()
+		if err != nil {
+			return err
+		}
+		historyStore := &CloudantHistoryStore{
+			Service: service,
+			DbName:  GetEnvDefault("history_db_name", "health_check_history"),
+		}
+		err = historyStore.SaveHistory(ctx, HistoryDoc{
+			RunDate:     todayString,
+			IngestDate:  ingestDate.Format("2006-01-02"),
+			IngestStart: summary.IngestStart,
+			IngestEnd:   summary.IngestEnd,
+			MagData:     allMagData,
+		})
+		if err != nil {
+			logErrorf("Error saving history to Cloudant: %s\n", err)
+		}
+	}
+
+	// Skip the email if nothing changed since the last run, if asked to
+	lastRunFile := GetEnvDefault("last_run_file", "last_run_data.json")
+	sendReport := true
+	// Only remember this run's data once it has actually been emailed, so a
+	// dry run or storage-only run doesn't hold back the next real report
+	reportDelivered := false
+	if os.Getenv("output_storage_only") == "true" && len(summary.ReportURLs) > 0 {
+		logf("Report uploaded to storage only, not emailing it\n")
+		sendReport = false
+	}
+	if os.Getenv("send_on_change_only") == "true" {
+		lastMagData, err := LoadLastRunData(lastRunFile)
+		if err != nil {
+			logErrorf("Error loading last run data, sending anyway: %s\n", err)
+		} else if lastMagData != nil && MagDataEqual(lastMagData, allMagData) {
+			logf("Article data unchanged since the last run, not sending the report\n")
+			sendReport = false
+			reportDelivered = true
+		}
+	}
+
+	if sendReport && os.Getenv("dry_run") == "true" {
+		logf("Dry run: not sending %q\n", payload.Subject)
+		sendReport = false
+	}
+	if sendReport {
+		phaseStart = time.Now()
+		err = SendBrevoEmail(ctx, httpClient, payload)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("run cancelled before the report was sent: %w", ctx.Err())
+			}
+			return fmt.Errorf("error sending report: %w", err)
+		}
+		logPhase("send_report", phaseStart)
+		reportDelivered = true
+	}
+
+	if os.Getenv("send_on_change_only") == "true" && retryData == nil && reportDelivered {
+		err = SaveLastRunData(lastRunFile, allMagData)
+		if err != nil {
+			logErrorf("Error saving last run data: %s\n", err)
+		}
+	}
+
+	// Post the summary to any chat notifiers that are configured
+	var notifiers []Notifier
+	if webhookURL := os.Getenv("slack_webhook_url"); webhookURL != "" {
+		notifiers = append(notifiers, &SlackNotifier{WebhookURL: webhookURL, Client: httpClient})
+	}
+	if webhookURL := os.Getenv("teams_webhook_url"); webhookURL != "" {
+		notifiers = append(notifiers, &TeamsNotifier{WebhookURL: webhookURL, Client: httpClient})
+	}
+	if len(notifiers) > 0 {
+		notification := Notification{
+			RunDate:         todayString,
+			TotalArticles:   reportData.TotalArticles,
+			FailedMagazines: failedMags,
+		}
+		for _, key := range keys {
+			if allMagData[key] == 0 && !reportData.ZeroSuppressed && !newFeeds[key] {
+				notification.ZeroIngestionMagazines = append(notification.ZeroIngestionMagazines, key)
+			}
+		}
+		for _, notifier := range notifiers {
+			if os.Getenv("dry_run") == "true" {
+				logf("Dry run: not sending %T notification\n", notifier)
+				continue
+			}
+			if err := notifier.Notify(ctx, notification); err != nil {
+				logErrorf("Error sending %T notification: %s\n", notifier, err)
+			}
+		}
+	}
+
+	logPhase("total", summary.StartTime)
+	logf("Done\n")
+
+	if pushURL := os.Getenv("pushgateway_url"); pushURL != "" {
+		if err := metrics.Push(ctx, httpClient, pushURL, "health_checker"); err != nil {
+			logErrorf("Error pushing metrics: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// LastRunData is what we persist between runs to detect unchanged data
+type LastRunData struct {
+	RunDate string         `json:"run_date"`
+	MagData map[string]int `json:"mag_data"`
+}
+
+// LoadLastRunData reads the previous run's article counts, returning nil if
+// there's no previous run
+func LoadLastRunData(path string) (map[string]int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var last LastRunData
+	if err := json.Unmarshal(b, &last); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", path, err)
+	}
+	return last.MagData, nil
+}
+
+// SaveLastRunData writes this run's article counts for the next run
+func SaveLastRunData(path string, magData map[string]int) error {
+	b, err := json.Marshal(LastRunData{
+		RunDate: time.Now().UTC().Format("2006-1-2"),
+		MagData: magData,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// FailedFeedsData is the magazines a run couldn't check, for a later rerun
+type FailedFeedsData struct {
+	RunID      string   `json:"run_id"`
+	IngestDate string   `json:"ingest_date"`
+	Magazines  []string `json:"magazines"`
+}
+
+// SaveFailedFeeds writes the run's failed magazines to path
+func SaveFailedFeeds(path string, data FailedFeedsData) error {
+	if data.Magazines == nil {
+		data.Magazines = []string{}
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// LoadFailedFeeds reads the failed magazines saved by an earlier run
+func LoadFailedFeeds(path string) (*FailedFeedsData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var data FailedFeedsData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", path, err)
+	}
+	return &data, nil
+}
+
+// OnlyFeeds keeps just the feeds whose name is in names
+func OnlyFeeds(feeds []Feed, names []string) []Feed {
+	keep := make(map[string]bool)
+	for _, name := range names {
+		keep[name] = true
+	}
+	var kept []Feed
+	for _, feed := range feeds {
+		if keep[feed.Name()] {
+			kept = append(kept, feed)
+		}
+	}
+	return kept
+}
+
+// MagDataEqual reports whether both runs have the same magazines with the
+// same article counts
+func MagDataEqual(a map[string]int, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, articles := range a {
+		if other, ok := b[key]; !ok || other != articles {
+			return false
+		}
+	}
+	return true
+}
+
+// Notification is the run summary posted to chat notifiers
+type Notification struct {
+	RunDate                string
+	TotalArticles          int
+	ZeroIngestionMagazines []string
+	FailedMagazines        []string
+}
+
+// Notifier posts the run summary somewhere other than the report email
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// SlackNotifier posts the run summary to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, notification Notification) error {
+	var text strings.Builder
+	fmt.Fprintf(&text, "*%s Feed Health Status %s*\n", ProgramName(), notification.RunDate)
+	fmt.Fprintf(&text, "Total articles ingested: %d\n", notification.TotalArticles)
+	if len(notification.ZeroIngestionMagazines) == 0 {
+		text.WriteString("No magazines with zero ingestion")
+	} else {
+		fmt.Fprintf(&text, "Magazines with zero ingestion (%d):\n", len(notification.ZeroIngestionMagazines))
+		for _, mag := range notification.ZeroIngestionMagazines {
+			fmt.Fprintf(&text, "• %s\n", mag)
+		}
+	}
+
+	payloadJson, err := json.Marshal(map[string]string{"text": text.String()})
+	if err != nil {
+		return fmt.Errorf("error encoding Slack payload: %s", err)
+	}
+	return postJSON(ctx, s.Client, s.WebhookURL, payloadJson)
+}
+
+// TeamsNotifier posts the run summary to a Microsoft Teams incoming webhook
+// as an Adaptive Card
+type TeamsNotifier struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+func (t *TeamsNotifier) Notify(ctx context.Context, notification Notification) error {
+	textBlock := func(text string, bold bool) map[string]interface{} {
+		block := map[string]interface{}{
+			"type": "TextBlock",
+			"text": text,
+			"wrap": true,
+		}
+		if bold {
+			block["weight"] = "Bolder"
+		}
+		return block
+	}
+	bulletList := func(items []string) string {
+		var list strings.Builder
+		for _, item := range items {
+			fmt.Fprintf(&list, "- %s\n", item)
+		}
+		return list.String()
+	}
+
+	body := []map[string]interface{}{
+		textBlock(ProgramName()+" Feed Health Status "+notification.RunDate, true),
+		textBlock(fmt.Sprintf("Total articles ingested: %d", notification.TotalArticles), false),
+	}
+	if len(notification.ZeroIngestionMagazines) > 0 {
+		body = append(body,
+			textBlock(fmt.Sprintf("Magazines with zero ingestion (%d):", len(notification.ZeroIngestionMagazines)), true),
+			textBlock(bulletList(notification.ZeroIngestionMagazines), false))
+	}
+	if len(notification.FailedMagazines) > 0 {
+		body = append(body,
+			textBlock(fmt.Sprintf("Magazines whose DB lookups failed (%d):", len(notification.FailedMagazines)), true),
+			textBlock(bulletList(notification.FailedMagazines), false))
+	}
+
+	card := map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    body,
+				},
+			},
+		},
+	}
+	payloadJson, err := json.Marshal(card)
+	if err != nil {
+		return fmt.Errorf("error encoding Teams payload: %s", err)
+	}
+	return postJSON(ctx, t.Client, t.WebhookURL, payloadJson)
+}
+
+// postJSON POSTs body to url and returns an error on a non-2xx response
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST returned status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// StartHealthServer serves /healthz, which is always OK once we're up, and
+// /readyz, which is OK once ready is set
+func StartHealthServer(port string, ready *atomic.Bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "not ready")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	go func() {
+		logf("Serving health checks on :%s\n", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logErrorf("Health server error: %s\n", err)
+		}
+	}()
+	return server
+}
+
+// NewRunID returns a timestamp-prefixed random ID for this run
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// Metrics is a minimal set of Prometheus counters and per-magazine gauges,
+// written out in the Prometheus text exposition format
+type Metrics struct {
+	mu        sync.Mutex
+	counters  map[string]float64
+	magGauges map[string]map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:  make(map[string]float64),
+		magGauges: make(map[string]map[string]float64),
+	}
+}
+
+// Add increments the named counter by v
+func (m *Metrics) Add(name string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += v
+}
+
+// SetMagazine sets the named gauge for a magazine
+func (m *Metrics) SetMagazine(name string, magazine string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.magGauges[name] == nil {
+		m.magGauges[name] = make(map[string]float64)
+	}
+	m.magGauges[name][magazine] = v
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "# TYPE %s counter\n%s %v\n", name, name, m.counters[name])
+	}
+
+	names = names[:0]
+	for name := range m.magGauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		mags := make([]string, 0, len(m.magGauges[name]))
+		for mag := range m.magGauges[name] {
+			mags = append(mags, mag)
+		}
+		sort.Strings(mags)
+		for _, mag := range mags {
+			fmt.Fprintf(&buf, "%s{magazine=%s} %v\n", name, strconv.Quote(mag), m.magGauges[name][mag])
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// Push sends the metrics to a Prometheus Pushgateway under the given job
+func (m *Metrics) Push(ctx context.Context, client *http.Client, gatewayURL string, job string) error {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", joinURL(gatewayURL, "metrics/job/"+url.PathEscape(job)), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// StartMetricsServer serves /metrics for Prometheus to scrape
+func StartMetricsServer(port string, m *Metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	})
+
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+	go func() {
+		logf("Serving metrics on :%s\n", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logErrorf("Metrics server error: %s\n", err)
+		}
+	}()
+	return server
+}
+
+// Clock is the time source for the scheduler, so tests can fake it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the wall clock in Loc, so schedule_cron is read in the
+// report timezone rather than the container's
+type realClock struct {
+	Loc *time.Location
+}
+
+func (c realClock) Now() time.Time                       { return time.Now().In(c.Loc) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RunScheduled calls fn every time cron fires until ctx is cancelled. The
+// cron is matched against the clock's time, including its location.
+func RunScheduled(ctx context.Context, cron *Cron, clock Clock, fn func(ctx context.Context) error) {
+	for {
+		next, ok := cron.Next(clock.Now())
+		if !ok {
+			logErrorf("Schedule never fires again, stopping the scheduler\n")
+			return
+		}
+		logf("Next scheduled run at %s\n", next.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			logf("Scheduler stopped: %s\n", ctx.Err())
+			return
+		case <-clock.After(next.Sub(clock.Now())):
+		}
+
+		logf("Starting scheduled run\n")
+		if err := fn(ctx); err != nil {
+			logErrorf("Scheduled run failed: %s\n", err)
+		}
+	}
+}
+
+// Cron is a parsed standard 5-field cron expression:
+// minute hour day-of-month month day-of-week
+type Cron struct {
+	minute, hour, dom, month, dow []bool
+	domAny, dowAny                bool
+}
+
+// ParseCron parses a 5-field cron expression. Each field may be *, a number,
+// a range (a-b), a list (a,b), and any of those with a step (*/n, a-b/n).
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	c := &Cron{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %s", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %s", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %s", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %s", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %s", err)
+	}
+	// Both 0 and 7 mean Sunday
+	c.dow[0] = c.dow[0] || c.dow[7]
+	if !c.canFire() {
+		return nil, fmt.Errorf("%q never fires", expr)
+	}
+	return c, nil
+}
+
+// canFire reports whether some day of some selected month matches, e.g.
+// "0 0 30 2 *" can't since February never has a 30th. Only a restricted
+// day of month can rule out every day: a restricted day of week matches
+// some day in every month.
+func (c *Cron) canFire() bool {
+	if c.domAny || !c.dowAny {
+		return true
+	}
+	// Longest each month can be, counting February 29th
+	monthDays := []int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+	for month := 1; month <= 12; month++ {
+		if !c.month[month] {
+			continue
+		}
+		for day := 1; day <= monthDays[month]; day++ {
+			if c.dom[day] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time after t, to the minute, that the cron fires,
+// in t's location. It returns false if there's no such time.
+func (c *Cron) Next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Any expression that fires at all does so within ~4 years (Feb 29)
+	for i := 0; i < 4*366*24*60; i++ {
+		if c.matches(t) {
+			return t, true
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+func (c *Cron) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	domMatch := c.dom[t.Day()]
+	dowMatch := c.dow[int(t.Weekday())]
+	// Like standard cron, if both day fields are restricted either can match
+	if !c.domAny && !c.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// logf logs to stdout, tagging the line with the run ID
+func logf(format string, args ...interface{}) {
+	fmt.Printf("run_id=%s "+format, append([]interface{}{runID}, args...)...)
+}
+
+// logErrorf logs to stderr, tagging the line with the run ID
+func logErrorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "run_id=%s "+format, append([]interface{}{runID}, args...)...)
+}
+
+// logPhase logs how long a phase of the run took since start
+func logPhase(phase string, start time.Time) {
+	logf("program=%q phase=%s duration_ms=%d\n", ProgramName(), phase, time.Since(start).Milliseconds())
+}
+
+// ProgramName is the publisher program this deployment reports on, used to
+// brand the sender, subjects and logs
+func ProgramName() string {
+	return GetEnvDefault("program_name", "RSS")
+}
+
+// NewBrevoSender builds the sender identity from program_name and sender_email
+func NewBrevoSender() BrevoSender {
+	return BrevoSender{
+		Name:  ProgramName() + " Mailer",
+		Email: GetEnvDefault("sender_email", "WM.RSS.mailer@gmail.com"),
+	}
+}
+
+// ValidationCheck is one dependency to smoke test in validate_only mode
+type ValidationCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ValidationChecks builds a check for every dependency the configured run
+// would use
+func ValidationChecks(config *Config) []ValidationCheck {
+	var checks []ValidationCheck
+	if os.Getenv("feeds_file") == "" {
+		checks = append(checks, ValidationCheck{Name: "cloudant", Check: func(ctx context.Context) error {
+			service, err := cloudantv1.NewCloudantV1UsingExternalConfig(&cloudantv1.CloudantV1Options{})
+			if err != nil {
+				return fmt.Errorf("error initializing Cloudant Service: %s", err)
+			}
+			return CheckCloudant(ctx, service, os.Getenv("db_name"))
+		}})
+	}
+	if os.Getenv("db_fixture_json") == "" {
+		for _, dbURL := range config.DBURLs {
+			baseDBURL := joinURL(dbURL, GetEnvDefault("db_article_path", "v2/get-article-by-ingestdate-magazine"))
+			checks = append(checks, ValidationCheck{Name: "db " + dbURL, Check: func(ctx context.Context) error {
+				cert, err := LoadDBClientCert()
+				if err != nil {
+					return err
+				}
+				client := httpClient
+				if cert != nil {
+					client = WithClientCert(client, cert)
+				}
+				return CheckDB(ctx, client, baseDBURL)
+			}})
+		}
+	}
+	checks = append(checks, ValidationCheck{Name: "brevo", Check: func(ctx context.Context) error {
+		return CheckBrevo(ctx, httpClient)
+	}})
+	return checks
+}
+
+// Validate runs every check, printing pass/fail for each. Returns whether
+// they all passed.
+func Validate(ctx context.Context, checks []ValidationCheck) bool {
+	ok := true
+	for _, check := range checks {
+		if err := check.Check(ctx); err != nil {
+			logf("FAIL %s: %s\n", check.Name, err)
+			ok = false
+			continue
+		}
+		logf("PASS %s\n", check.Name)
+	}
+	return ok
+}
+
+// CheckCloudant runs a one-document query against the feed database
+func CheckCloudant(ctx context.Context, service *cloudantv1.CloudantV1, dbName string) error {
+	limit := int64(1)
+	_, _, err := service.PostFindWithContext(ctx, &cloudantv1.PostFindOptions{
+		Db:       &dbName,
+		Selector: map[string]interface{}{"_id": map[string]interface{}{"$gt": nil}},
+		Limit:    &limit,
+	})
+	return err
+}
+
+// CheckDB looks up yesterday's articles for a placeholder magazine, which
+// should succeed with no rows
+func CheckDB(ctx context.Context, client *http.Client, baseDBURL string) error {
+	params := DBQueryParams("health-checker-validate", time.Now().Add(-24*time.Hour))
+	return checkGet(ctx, WithDBAuth(client), baseDBURL+"?"+params.Encode(), nil)
+}
+
+// CheckBrevo fetches the Brevo account, which checks the API key is valid
+func CheckBrevo(ctx context.Context, client *http.Client) error {
+	accountURL := strings.TrimSuffix(GetEnvDefault("brevo_base_url", "https://api.brevo.com/v3"), "/") + "/account"
+	return checkGet(ctx, client, accountURL, map[string]string{
+		"api-key": os.Getenv("brevo_api_key"),
+		"Accept":  "application/json",
+	})
+}
+
+// checkGet GETs target and fails unless it answers 2xx
+func checkGet(ctx context.Context, client *http.Client, target string, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// runWithAlert runs the health check and, if it fails outright, tells the
+// critical_recipients. A failure to send the alert is only logged so it
+// doesn't mask the run's error.
+func runWithAlert(ctx context.Context, config *Config) error {
+	err := run(ctx, config)
+	if err == nil {
+		return nil
+	}
+	// Being stopped by SIGTERM/SIGINT (e.g. a deploy) isn't worth paging anyone
+	if errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled) {
+		return err
+	}
+	// The run's context may already be cancelled, so give the alert its own
+	alertCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if alertErr := SendCriticalAlert(alertCtx, httpClient, err); alertErr != nil {
+		logErrorf("Error sending critical failure alert: %s\n", alertErr)
+	}
+	return err
+}
+
+// SendCriticalAlert emails the critical_recipients the error that aborted
+// the run. Does nothing if there are none configured.
+func SendCriticalAlert(ctx context.Context, client *http.Client, runErr error) error {
+	var toList []BrevoTo
+	for _, email := range SplitList(os.Getenv("critical_recipients")) {
+		toList = append(toList, BrevoTo{Email: email})
+	}
+	if len(toList) == 0 {
+		return nil
+	}
+	category, _ := ErrorCategory(runErr)
+
+	payload := BrevoQuery{
+		Sender:  NewBrevoSender(),
+		To:      toList,
+		Subject: fmt.Sprintf("%s Feed Health Check failed (%s error)", ProgramName(), category),
+		HtmlContent: fmt.Sprintf("<html><head></head><body><p>The health check run failed before sending its report:</p><pre>%s</pre><p>Run ID: %s</p></body></html>",
+			html.EscapeString(runErr.Error()), runID),
+		Headers: map[string]string{"X-Run-ID": runID},
+	}
+	if os.Getenv("dry_run") == "true" {
+		logf("Dry run: not sending %q\n", payload.Subject)
+		return nil
+	}
+	return SendBrevoEmail(ctx, client, payload)
+}
+
+// SendFailureAlert emails the ops recipients the list of magazines whose
+// DB lookups failed every retry. Nothing is sent if ops_email_addresses is
+// unset.
+func SendFailureAlert(ctx context.Context, client *http.Client, failedMags []string, lastErr error) error {
+	var toList []BrevoTo
+	for _, email := range SplitList(os.Getenv("ops_email_addresses")) {
+		toList = append(toList, BrevoTo{Email: email})
+	}
+	if len(toList) == 0 {
+		return nil
+	}
+
+	var body strings.Builder
+	body.WriteString("<html><head></head><body>")
+	fmt.Fprintf(&body, "<p>%d magazines failed all DB lookup retries. The last error seen was:</p>", len(failedMags))
+	fmt.Fprintf(&body, "<pre>%s</pre><ul>", html.EscapeString(fmt.Sprint(lastErr)))
+	for _, mag := range failedMags {
+		fmt.Fprintf(&body, "<li>%s</li>", html.EscapeString(mag))
+	}
+	fmt.Fprintf(&body, "</ul><p>Run ID: %s</p></body></html>", runID)
+
+	payload := BrevoQuery{
+		Sender:      NewBrevoSender(),
+		To:          toList,
+		Subject:     fmt.Sprintf("%s Feed Health Check: %d DB lookups failed", ProgramName(), len(failedMags)),
+		HtmlContent: body.String(),
+		Headers:     map[string]string{"X-Run-ID": runID},
+	}
+	if os.Getenv("dry_run") == "true" {
+		logf("Dry run: not sending %q\n", payload.Subject)
+		return nil
+	}
+	return SendBrevoEmail(ctx, client, payload)
+}
+
+// NewHTTPClient builds an http.Client with connection pooling tuned for the
+// DB fan-out. It goes through the proxy in proxy_url if set, otherwise
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY.
+func NewHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL := os.Getenv("proxy_url"); proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil || u.Host == "" {
+			logErrorf("Invalid proxy_url %q, using the proxy environment instead\n", proxyURL)
+		} else {
+			transport.Proxy = http.ProxyURL(u)
+		}
+	}
+	// Every DB lookup waits on the max_concurrency limiter first, so there are
+	// never more connections in flight than that. Keep these at or below
+	// max_concurrency unless the DB can take more.
+	transport.MaxIdleConns = transportLimit("http_max_idle_conns", 100)
+	transport.MaxIdleConnsPerHost = transportLimit("http_max_idle_conns_per_host", 100)
+	transport.MaxConnsPerHost = transportLimit("http_max_conns_per_host", 0)
+	transport.IdleConnTimeout = 90 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+// transportLimit reads a connection limit for the shared transport, falling
+// back to def if it's unset or invalid. 0 means no limit.
+func transportLimit(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		logErrorf("Invalid %s %q, using %d instead\n", key, value, def)
+		return def
+	}
+	return n
+}
+
+// BrevoTemplateParams builds the substitution params for a Brevo template
+// version of the report. Magazines in newFeeds are left out of the zero
+// ingestion list, as they are everywhere else.
+func BrevoTemplateParams(data ReportData, allMagData map[string]int, keys []string, failedMags []string, newFeeds map[string]bool) map[string]interface{} {
+	zeroMags := []string{}
+	if !data.ZeroSuppressed {
+		for _, key := range keys {
+			if allMagData[key] == 0 && !newFeeds[key] {
+				zeroMags = append(zeroMags, key)
+			}
+		}
+	}
+	if failedMags == nil {
+		failedMags = []string{}
+	}
+	return map[string]interface{}{
+		"program_name":     data.ProgramName,
+		"run_date":         data.RunDate,
+		"total_magazines":  data.TotalMagazines,
+		"total_articles":   data.TotalArticles,
+		"zero_ingestion":   data.ZeroIngestion,
+		"zero_percent":     data.ZeroPercent,
+		"failed_feeds":     data.FailedFeeds,
+		"stale_feeds":      data.StaleFeeds,
+		"unhealthy_feeds":  data.UnhealthyFeeds,
+		"zero_magazines":   zeroMags,
+		"failed_magazines": failedMags,
+		"healthy":          data.Healthy(),
+	}
+}
+
+// SendBrevoEmail POSTs the payload to the Brevo transactional email API
+func SendBrevoEmail(ctx context.Context, client *http.Client, payload BrevoQuery) error {
+	payload.To = dedupeRecipients(filterRecipients(payload.To))
+	// Anyone already in To doesn't need to be Cc'd as well
+	all := append(append([]BrevoTo{}, payload.To...), filterRecipients(payload.Cc)...)
+	payload.Cc = dedupeRecipients(all)[len(payload.To):]
+	// Likewise for anyone in To or Cc getting a Bcc
+	shown := len(payload.To) + len(payload.Cc)
+	all = append(append(append([]BrevoTo{}, payload.To...), payload.Cc...), filterRecipients(payload.Bcc)...)
+	payload.Bcc = dedupeRecipients(all)[shown:]
+	if len(payload.To) == 0 {
+		return fmt.Errorf("no valid recipients for %q", payload.Subject)
+	}
+
+	for _, attachment := range payload.Attachment {
+		if attachment.Content == "" {
+			return fmt.Errorf("attachment %q has no content", attachment.Name)
+		}
+	}
+
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding Brevo payload: %s", err)
+	}
+	brevoURL := strings.TrimSuffix(GetEnvDefault("brevo_base_url", "https://api.brevo.com/v3"), "/") + "/smtp/email"
+	req, err := http.NewRequestWithContext(ctx, "POST", brevoURL, bytes.NewBuffer(payloadJson))
+	if err != nil {
+		return fmt.Errorf("error creating HTTP request to Brevo: %s", err)
+	}
+	req.Header.Set("api-key", os.Getenv("brevo_api_key"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "health-checker/"+version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &BrevoError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &BrevoError{Err: fmt.Errorf("Brevo returned status %d: %s", resp.StatusCode, body)}
+	}
+	metrics.Add("health_checker_emails_sent_total", 1)
+	return nil
+}
+
+// validateEmail reports whether s is a bare email address, without a display
+// name or angle brackets, since Brevo wants just the address
+func validateEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// filterRecipients drops any invalid addresses from the list
+func filterRecipients(recipients []BrevoTo) []BrevoTo {
+	var valid []BrevoTo
+	for _, r := range recipients {
+		if !validateEmail(r.Email) {
+			logErrorf("Skipping invalid recipient email address: %q\n", r.Email)
+			continue
+		}
+		valid = append(valid, r)
+	}
+	return valid
+}
+
+// dedupeRecipients drops repeated addresses, ignoring case, keeping the first
+func dedupeRecipients(recipients []BrevoTo) []BrevoTo {
+	seen := make(map[string]bool)
+	var deduped []BrevoTo
+	for _, r := range recipients {
+		key := strings.ToLower(strings.TrimSpace(r.Email))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, r)
+	}
+	return deduped
+}
+
+// SplitList splits a comma-separated env var value, trimming each entry and
+// dropping empty ones
+func SplitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Config is the settings validateConfig checked and normalized at startup
+type Config struct {
+	DBURLs []string // sql_db_url, each ending with a slash
+}
+
+// validateConfig checks the DB client certificate loads, db_auth_mode is known
+// and sql_db_url is set (unless db_fixture_json stands in for the DB) to
+// absolute HTTP(S) URLs, which it normalizes to end with a slash
+func validateConfig() (*Config, error) {
+	if _, err := LoadDBClientCert(); err != nil {
+		return nil, configErrorf("invalid db_client_cert/db_client_key: %s", err)
+	}
+	if mode := os.Getenv("db_auth_mode"); mode != "" && mode != "query" && mode != "header" {
+		return nil, configErrorf("db_auth_mode must be query or header, not %q", mode)
+	}
+	config := &Config{}
+	for _, dbURL := range SplitList(os.Getenv("sql_db_url")) {
+		normalized, err := NormalizeBaseURL(dbURL)
+		if err != nil {
+			return nil, configErrorf("sql_db_url: %s", err)
+		}
+		config.DBURLs = append(config.DBURLs, normalized)
+	}
+	if len(config.DBURLs) == 0 && os.Getenv("db_fixture_json") == "" {
+		return nil, configErrorf("no sql_db_url configured")
+	}
+	return config, nil
+}
+
+// NormalizeBaseURL checks raw is an absolute HTTP(S) URL and makes sure it
+// ends with a slash so paths can be appended to it
+func NormalizeBaseURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %s", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+// joinURL joins base and path with exactly one slash between them
+func joinURL(base string, path string) string {
+	if path == "" {
+		return base
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// LoadReportLocation loads the named IANA timezone, falling back to UTC if
+// it's unset or invalid
+func LoadReportLocation(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logErrorf("Invalid report_timezone %q, using UTC: %s\n", name, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// DefaultIngestDate is the day to report on when none is given: 24 hours
+// before now, in the report timezone
+func DefaultIngestDate(now time.Time, loc *time.Location) time.Time {
+	return now.In(loc).Add(-24 * time.Hour)
+}
+
+// GetEnvDefault returns the value of the env var, or def if it's unset or empty
+func GetEnvDefault(key string, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
+
+// RenderTemplate executes the text/template tmpl against data. Templates can
+// use {{thousands .N}} to format counts with comma grouping.
+func RenderTemplate(name string, tmpl string, data interface{}) (string, error) {
+	t, err := template.New(name).Funcs(template.FuncMap{"thousands": FormatThousands}).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DBQueryParams builds the query for one magazine's articles on ingestDate
+func DBQueryParams(magazine string, ingestDate time.Time) url.Values {
+	params := url.Values{}
+	if os.Getenv("db_auth_mode") != "header" {
+		params.Add("apikey", os.Getenv("sql_db_apikey"))
+	}
+	params.Add("ingestdate", ingestDate.Format("2006-1-2"))
+	params.Add("magazine", magazine)
+	return params
+}
+
+// SplitBatchable separates the feeds that can share a batched DB lookup from
+// those whose names contain a comma, which would break the magazines list
+func SplitBatchable(feeds []Feed) ([]Feed, []Feed) {
+	var batchable, single []Feed
+	for _, feed := range feeds {
+		if strings.Contains(feed.FeedName, ",") {
+			single = append(single, feed)
+		} else {
+			batchable = append(batchable, feed)
+		}
+	}
+	return batchable, single
+}
+
+// DBBatchQueryParams builds the query for several magazines' articles on
+// ingestDate in one lookup. Names must not contain commas, see SplitBatchable.
+func DBBatchQueryParams(magazines []string, ingestDate time.Time) url.Values {
+	params := DBQueryParams("", ingestDate)
+	params.Del("magazine")
+	params.Add("magazines", strings.Join(magazines, ","))
+	return params
+}
+
+// WithDBAuth sends sql_db_apikey in the db_auth_header header (X-API-Key by
+// default) instead of the URL when db_auth_mode is "header", so it stays out
+// of server and proxy logs
+func WithDBAuth(client *http.Client) *http.Client {
+	if os.Getenv("db_auth_mode") != "header" {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport: &HeaderTransport{
+			Base:   base,
+			Header: GetEnvDefault("db_auth_header", "X-API-Key"),
+			Value:  os.Getenv("sql_db_apikey"),
+		},
+		Timeout: client.Timeout,
+	}
+}
+
+// LoadDBClientCert loads the DB client certificate from db_client_cert and
+// db_client_key, each either a file path or the PEM itself. Returns nil if
+// neither is set.
+func LoadDBClientCert() (*tls.Certificate, error) {
+	certValue, keyValue := os.Getenv("db_client_cert"), os.Getenv("db_client_key")
+	if certValue == "" && keyValue == "" {
+		return nil, nil
+	}
+	if certValue == "" || keyValue == "" {
+		return nil, fmt.Errorf("db_client_cert and db_client_key must be set together")
+	}
+	certPEM, err := readPEM(certValue)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPEM(keyValue)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// readPEM returns value if it's PEM already, otherwise reads the file it names
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// WithClientCert returns a copy of client that presents cert on TLS connections
+func WithClientCert(client *http.Client, cert *tls.Certificate) *http.Client {
+	base, ok := client.Transport.(*http.Transport)
+	if !ok || base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
+
+// HeaderTransport sets a header on every request before passing it to Base
+type HeaderTransport struct {
+	Base   http.RoundTripper
+	Header string
+	Value  string
+}
+
+func (t *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(t.Header, t.Value)
+	return t.Base.RoundTrip(req)
+}
+
+// AddIngestRange adds explicit start and end timestamps to a DB query, for
+// endpoints that support them. ingestdate is kept for those that don't.
+func AddIngestRange(params url.Values, start time.Time, end time.Time) {
+	params.Set("start", start.Format(time.RFC3339))
+	params.Set("end", end.Format(time.RFC3339))
+}
+
+// FetchArticles gets the articles and their count for one DB lookup,
+// retrying up to 10 times unless breaker trips. breaker may be nil.
+func FetchArticles(ctx context.Context, client *http.Client, breaker *CircuitBreaker, countMode string, i int, fullDBURL string) ([]DBRow, int, int, error) {
+	var dbRes []DBRow
+	var count int
+	attempts, err := fetchDB(ctx, client, breaker, i, fullDBURL, func(r io.Reader) error {
+		var err error
+		dbRes, count, err = DecodeDBResponse(r, countMode)
+		return err
+	})
+	if err != nil {
+		return nil, 0, attempts, err
+	}
+	return dbRes, count, attempts, nil
+}
+
+// FetchArticleBatch gets the articles and their counts for several magazines
+// in one DB lookup, keyed by magazine, retrying like FetchArticles
+func FetchArticleBatch(ctx context.Context, client *http.Client, breaker *CircuitBreaker, countMode string, i int, fullDBURL string) (map[string][]DBRow, map[string]int, int, error) {
+	var rows map[string][]DBRow
+	var counts map[string]int
+	attempts, err := fetchDB(ctx, client, breaker, i, fullDBURL, func(r io.Reader) error {
+		var err error
+		rows, counts, err = DecodeDBBatchResponse(r, countMode)
+		return err
+	})
+	if err != nil {
+		return nil, nil, attempts, err
+	}
+	return rows, counts, attempts, nil
+}
+
+// fetchDB GETs fullDBURL and decodes a 2xx response with decode, retrying up
+// to 10 times unless breaker trips. Returns how many attempts it took.
+func fetchDB(ctx context.Context, client *http.Client, breaker *CircuitBreaker, i int, fullDBURL string, decode func(io.Reader) error) (int, error) {
+	var lastErr error
+	attempts := 0
+	for j := 0; j < 10; j++ {
+		if ctx.Err() != nil {
+			return attempts, ctx.Err()
+		}
+		if breaker.Open() {
+			return attempts, ErrDBUnavailable
+		}
+		attempts++
+		req, err := http.NewRequestWithContext(ctx, "GET", fullDBURL, nil)
+		if err != nil {
+			logErrorf("%d: error creating DB request: %s\n", i, err)
+			return attempts, err
+		}
+		res, err := client.Do(req)
+
+		if err == nil && res.StatusCode/100 == 2 {
+			err := decode(res.Body)
+			res.Body.Close()
+			if err != nil {
+				logErrorf("%d: JSON decode for DB ROW error: %s\n", i, err)
+				return attempts, &DBError{Err: err}
+			}
+			breaker.Success()
+			return attempts, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("DB returned status %d", res.StatusCode)
+		}
+		lastErr = err
+		breaker.Failure()
+
+		// Something went wrong, pause and try again
+		body := []byte{}
+		if res != nil {
+			body, _ = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		logErrorf("%d: DB attempt %d failed: %s body=%q\n", i, attempts, err, string(body))
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return attempts, &DBError{Err: lastErr}
+}
+
+// DecodeDBBatchResponse decodes a batched DB lookup, an object keyed by
+// magazine whose values are what DecodeDBResponse expects for one magazine.
+// Returns the articles and counts by magazine.
+func DecodeDBBatchResponse(r io.Reader, countMode string) (map[string][]DBRow, map[string]int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	rows := make(map[string][]DBRow, len(raw))
+	counts := make(map[string]int, len(raw))
+	for magazine, body := range raw {
+		dbRes, count, err := DecodeDBResponse(bytes.NewReader(body), countMode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("magazine %q: %s", magazine, err)
+		}
+		rows[magazine] = dbRes
+		counts[magazine] = count
+	}
+	return rows, counts, nil
+}
+
+// DBCountResponse is the DB response in db_count_mode=field: the total
+// article count, which may be more than the articles on this page
+type DBCountResponse struct {
+	TotalCount int     `json:"total_count"`
+	Articles   []DBRow `json:"articles"`
+}
+
+// DecodeDBResponse decodes a DB lookup's articles and how many there are.
+// In "rows" mode the response is a list of articles, counted with len; in
+// "field" mode it's a DBCountResponse.
+func DecodeDBResponse(r io.Reader, countMode string) ([]DBRow, int, error) {
+	if countMode == "field" {
+		var dbRes DBCountResponse
+		if err := json.NewDecoder(r).Decode(&dbRes); err != nil {
+			return nil, 0, err
+		}
+		return dbRes.Articles, dbRes.TotalCount, nil
+	}
+	var dbRes []DBRow
+	if err := json.NewDecoder(r).Decode(&dbRes); err != nil {
+		return nil, 0, err
+	}
+	return dbRes, len(dbRes), nil
+}
+
+// ErrDBUnavailable is returned for lookups skipped because the breaker tripped
+var ErrDBUnavailable = &DBError{Err: errors.New("DB unavailable: circuit breaker open")}
+
+// CircuitBreaker trips once there have been Threshold consecutive failures
+// within Window, and stays open for the rest of the run. A nil
+// *CircuitBreaker never trips.
+type CircuitBreaker struct {
+	Threshold int
+	Window    time.Duration
+
+	mu       sync.Mutex
+	failures int
+	first    time.Time
+	open     bool
+}
+
+// Open reports whether the breaker has tripped
+func (b *CircuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// Success resets the run of consecutive failures
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Failure counts a failure, tripping the breaker if it's hit the threshold
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.first) > b.Window {
+		b.failures = 0
+		b.first = now
+	}
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.open = true
+	}
+}
+
+// FixtureTransport answers DB lookups with canned rows instead of going to the
+// network, keyed on the magazine (or batched magazines) query param
+type FixtureTransport struct {
+	Counts map[string]int
+}
+
+// RoundTrip returns as many placeholder rows as the fixture has for the
+// magazine, or an object of them keyed by magazine for a batched lookup
+func (t *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	var payload interface{}
+	if query.Has("magazines") {
+		batch := map[string]interface{}{}
+		for _, magazine := range strings.Split(query.Get("magazines"), ",") {
+			batch[magazine] = t.payload(magazine)
+		}
+		payload = batch
+	} else {
+		payload = t.payload(query.Get("magazine"))
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// payload is the response body for one magazine, in the shape db_count_mode expects
+func (t *FixtureTransport) payload(magazine string) interface{} {
+	rows := make([]DBRow, t.Counts[magazine])
+	for k := range rows {
+		rows[k] = DBRow{
+			Id:              int64(k + 1),
+			ArticleTitle:    fmt.Sprintf("Fixture article %d", k+1),
+			ArticleMagazine: magazine,
+		}
+	}
+	if os.Getenv("db_count_mode") == "field" {
+		return DBCountResponse{TotalCount: len(rows), Articles: rows}
+	}
+	return rows
+}
+
+// LoadDBFixture reads a JSON object mapping magazine names to article counts
+func LoadDBFixture(path string) (*FixtureTransport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var counts map[string]int
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return &FixtureTransport{Counts: counts}, nil
+}
+
+// CombineDBRows merges the rows one feed got from each DB backend. "sum" keeps
+// them all, "max" keeps the backend that returned the most.
+func CombineDBRows(rowsByBackend [][]DBRow, mode string) []DBRow {
+	if len(rowsByBackend) == 1 {
+		return rowsByBackend[0]
+	}
+	var combined []DBRow
+	for _, rows := range rowsByBackend {
+		switch mode {
+		case "max":
+			if len(rows) > len(combined) {
+				combined = rows
+			}
+		default:
+			combined = append(combined, rows...)
+		}
+	}
+	return combined
+}
+
+// CombineCounts merges the article count one feed got from each DB backend,
+// summing them or taking the max to match CombineDBRows
+func CombineCounts(counts []int, mode string) int {
+	combined := 0
+	for _, count := range counts {
+		switch mode {
+		case "max":
+			if count > combined {
+				combined = count
+			}
+		default:
+			combined += count
+		}
+	}
+	return combined
+}
+
+// DBDiscrepancy reports whether the per-backend counts differ by more than threshold
+func DBDiscrepancy(counts []int, threshold int) bool {
+	if len(counts) < 2 {
+		return false
+	}
+	min, max := counts[0], counts[0]
+	for _, c := range counts[1:] {
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+	}
+	return max-min > threshold
+}
+
+// MagazineLink renders the HTML for a magazine name in the report, as a link
+// to urlTemplate, or as plain text if urlTemplate is empty. The template gets
+// the name escaped for a query parameter as .Magazine and for a path segment
+// as .MagazinePath.
+func MagazineLink(urlTemplate string, magazine string) (string, error) {
+	if urlTemplate == "" {
+		return html.EscapeString(magazine), nil
+	}
+	link, err := RenderTemplate("dashboard_url", urlTemplate, struct {
+		Magazine     string
+		MagazinePath string
+	}{url.QueryEscape(magazine), url.PathEscape(magazine)})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(magazine)), nil
+}
+
+// SanitizeFileName makes a rendered attachment name safe to use as a file name
+func SanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == ':':
+			return '_'
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "daily_article_data"
+	}
+	return name
+}
+
+// FormatThousands formats n with commas between groups of three digits
+func FormatThousands(n int) string {
+	digits := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+// FeedStore is a source of the feed list to health check
+type FeedStore interface {
+	GetFeeds(ctx context.Context) ([]Feed, error)
+}
+
+// MalformedDoc is a publisher document that was skipped because it couldn't
+// be parsed
+type MalformedDoc struct {
+	DocID string
+	Error string
+}
+
+// MalformedReporter is a FeedStore that can list the documents it skipped
+// during the last GetFeeds
+type MalformedReporter interface {
+	MalformedDocs() []MalformedDoc
+}
+
+// CloudantFeedStore loads the feed list from the publisher documents in Cloudant
+type CloudantFeedStore struct {
+	Service   *cloudantv1.CloudantV1
+	DbName    string
+	Selector  map[string]interface{} // nil for the default FeedSelector
+	PageLimit int64                  // docs per PostFind page, 0 for the default
+	Timeout   time.Duration          // per PostFind page, 0 for none
+
+	malformed []MalformedDoc
+}
+
+func (c *CloudantFeedStore) MalformedDocs() []MalformedDoc {
+	return c.malformed
+}
+
+// FeedSelector builds the Cloudant selector for the publisher documents.
+// selectorJSON, if set, replaces the whole selector; otherwise
+// publisherFilter, if set, narrows it to a single publisher.
+func FeedSelector(publisherFilter string, selectorJSON string) (map[string]interface{}, error) {
+	if selectorJSON != "" {
+		var selector map[string]interface{}
+		if err := json.Unmarshal([]byte(selectorJSON), &selector); err != nil {
+			return nil, fmt.Errorf("invalid selector JSON: %s", err)
+		}
+		if len(selector) == 0 {
+			return nil, fmt.Errorf("selector JSON is empty")
+		}
+		return selector, nil
+	}
+
+	// selector= {"_id": {"$gt": "0"},"Publisher_Name": {"$exists": True},"RSS_Feeds": {"$exists": True}},
+	selector := map[string]interface{}{
+		"_id": map[string]interface{}{
+			"$gt": "0",
+		},
+		"Publisher_Name": map[string]interface{}{
+			"$exists": true,
+		},
+		"RSS_Feeds": map[string]interface{}{
+			"$exists": true,
+		},
+	}
+	if publisherFilter != "" {
+		selector["Publisher_Name"] = map[string]interface{}{
+			"$eq": publisherFilter,
+		}
+	}
+	return selector, nil
+}
+
+func (c *CloudantFeedStore) GetFeeds(ctx context.Context) ([]Feed, error) {
+	// Query Cloudant for the feed list
+	selector := c.Selector
+	if selector == nil {
+		selector, _ = FeedSelector("", "")
+	}
+	limit := c.PageLimit
+	if limit <= 0 {
+		limit = 200
+	}
+	queryOptions := &cloudantv1.PostFindOptions{
+		Db:       &c.DbName,
+		Selector: selector,
+		Limit:    &limit,
+	}
+
+	// Execute the query, following the bookmark until we get a short page
+	var feeds []Feed
+	c.malformed = nil
+	for {
+		findCtx, cancel := ctx, context.CancelFunc(func() {})
+		if c.Timeout > 0 {
+			findCtx, cancel = context.WithTimeout(ctx, c.Timeout)
+		}
+		findResult, response, err := c.Service.PostFindWithContext(findCtx, queryOptions)
+		timedOut := findCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if err != nil {
+			if timedOut {
+				return nil, &CloudantError{Err: fmt.Errorf("Cloudant query timed out after %s", c.Timeout)}
+			}
+			err = fmt.Errorf("error finding all documents using Cloudant Service: %s", err)
+			// Auth and bad request errors won't go away by retrying
+			if response != nil && response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+				return nil, &CloudantError{Err: &NonRetryableError{Err: err}}
+			}
+			return nil, &CloudantError{Err: err}
+		}
+
+		// Parse Result from Cloudant to build slice of RSS Feeds
+		pageFeeds, malformed := ParseFeeds(findResult.Docs)
+		feeds = append(feeds, pageFeeds...)
+		c.malformed = append(c.malformed, malformed...)
+		if int64(len(findResult.Docs)) < limit || findResult.Bookmark == nil {
+			break
+		}
+		queryOptions.Bookmark = findResult.Bookmark
+	}
+	return feeds, nil
+}
+
+// ConfigError is a problem with the configuration in the environment
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func configErrorf(format string, args ...interface{}) error {
+	return &ConfigError{Err: fmt.Errorf(format, args...)}
+}
+
+// CloudantError is a failure talking to Cloudant
+type CloudantError struct {
+	Err error
+}
+
+func (e *CloudantError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CloudantError) Unwrap() error {
+	return e.Err
+}
+
+// DBError is a failure looking up articles in the SQL DB
+type DBError struct {
+	Err error
+}
+
+func (e *DBError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// BrevoError is a failure sending email through Brevo
+type BrevoError struct {
+	Err error
+}
+
+func (e *BrevoError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BrevoError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCategory names the kind of failure err is, and the exit code for it
+func ErrorCategory(err error) (string, int) {
+	var configErr *ConfigError
+	var cloudantErr *CloudantError
+	var dbErr *DBError
+	var brevoErr *BrevoError
+	switch {
+	case errors.As(err, &configErr):
+		return "config", 2
+	case errors.As(err, &cloudantErr):
+		return "cloudant", 3
+	case errors.As(err, &dbErr):
+		return "db", 4
+	case errors.As(err, &brevoErr):
+		return "brevo", 5
+	}
+	return "other", 1
+}
+
+// NonRetryableError marks an error that retrying won't fix
+type NonRetryableError struct {
+	Err error
+}
+
+func (e *NonRetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NonRetryableError) Unwrap() error {
+	return e.Err
+}
+
+// RetryFeedStore retries the wrapped FeedStore on retryable errors
+type RetryFeedStore struct {
+	Store      FeedStore
+	MaxRetries int
+	Delay      time.Duration
+}
+
+func (r *RetryFeedStore) GetFeeds(ctx context.Context) ([]Feed, error) {
+	var err error
+	for j := 0; j < r.MaxRetries; j++ {
+		var feeds []Feed
+		feeds, err = r.Store.GetFeeds(ctx)
+		var nonRetryable *NonRetryableError
+		if err == nil || errors.As(err, &nonRetryable) {
+			return feeds, err
+		}
+
+		// Something went wrong, pause and try again
+		logErrorf("Attempt %d of %d to load feeds failed: %s\n", j+1, r.MaxRetries, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.Delay):
+		}
+	}
+	return nil, err
+}
+
+func (r *RetryFeedStore) MalformedDocs() []MalformedDoc {
+	if m, ok := r.Store.(MalformedReporter); ok {
+		return m.MalformedDocs()
+	}
+	return nil
+}
+
+// HistoryDoc is one day's article counts, kept for trending
+type HistoryDoc struct {
+	RunDate     string         `json:"run_date"`
+	IngestDate  string         `json:"ingest_date"`
+	IngestStart string         `json:"ingest_start,omitempty"` // RFC3339
+	IngestEnd   string         `json:"ingest_end,omitempty"`   // RFC3339
+	MagData     map[string]int `json:"mag_data"`
+}
+
+// HistoryStore is somewhere to keep each day's article counts
+type HistoryStore interface {
+	SaveHistory(ctx context.Context, doc HistoryDoc) error
+	LoadHistory(ctx context.Context, ingestDates []string) ([]HistoryDoc, error)
+	LoadStreaks(ctx context.Context) (map[string]FeedStreak, error)
+	SaveStreaks(ctx context.Context, streaks map[string]FeedStreak) error
+}
+
+// FeedStreak is how a feed's DB lookups have been going across runs
+type FeedStreak struct {
+	LastSuccess   string `json:"last_success,omitempty"` // RFC3339
+	FailureStreak int    `json:"failure_streak"`
+}
+
+// UpdateStreaks records this run: magazines with data have their streak
+// reset, failed magazines have it extended
+func UpdateStreaks(streaks map[string]FeedStreak, allMagData map[string]int, failedMags []string, now time.Time) map[string]FeedStreak {
+	if streaks == nil {
+		streaks = make(map[string]FeedStreak)
+	}
+	for mag := range allMagData {
+		streaks[mag] = FeedStreak{LastSuccess: now.Format(time.RFC3339)}
+	}
+	for _, mag := range failedMags {
+		streak := streaks[mag]
+		streak.FailureStreak++
+		streaks[mag] = streak
+	}
+	return streaks
+}
+
+// FindPersistentFailures returns the magazines that have failed at least
+// threshold runs in a row, longest streak first
+func FindPersistentFailures(streaks map[string]FeedStreak, threshold int) []PersistentFailure {
+	var fails []PersistentFailure
+	for mag, streak := range streaks {
+		if streak.FailureStreak >= threshold {
+			fails = append(fails, PersistentFailure{Magazine: mag, FailureStreak: streak.FailureStreak, LastSuccess: streak.LastSuccess})
+		}
+	}
+	sort.Slice(fails, func(i, j int) bool {
+		if fails[i].FailureStreak != fails[j].FailureStreak {
+			return fails[i].FailureStreak > fails[j].FailureStreak
+		}
+		return fails[i].Magazine < fails[j].Magazine
+	})
+	return fails
+}
+
+// CloudantHistoryStore keeps one document per ingest date in a Cloudant
+// database, plus one for the failure streaks
+type CloudantHistoryStore struct {
+	Service *cloudantv1.CloudantV1
+	DbName  string
+
+	streaksRev *string // revision of the streaks doc, once loaded
+}
+
+const streaksDocID = "feed-streaks"
+
+func (c *CloudantHistoryStore) LoadStreaks(ctx context.Context) (map[string]FeedStreak, error) {
+	docID := streaksDocID
+	doc, response, err := c.Service.GetDocumentWithContext(ctx, &cloudantv1.GetDocumentOptions{
+		Db:    &c.DbName,
+		DocID: &docID,
+	})
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return make(map[string]FeedStreak), nil
+		}
+		return nil, &CloudantError{Err: err}
+	}
+	c.streaksRev = doc.Rev
+	b, err := json.Marshal(doc.GetProperty("streaks"))
+	if err != nil {
+		return nil, err
+	}
+	streaks := make(map[string]FeedStreak)
+	if err := json.Unmarshal(b, &streaks); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", streaksDocID, err)
+	}
+	return streaks, nil
+}
+
+func (c *CloudantHistoryStore) SaveStreaks(ctx context.Context, streaks map[string]FeedStreak) error {
+	docID := streaksDocID
+	document := &cloudantv1.Document{ID: &docID, Rev: c.streaksRev}
+	document.SetProperty("streaks", streaks)
+	result, _, err := c.Service.PostDocumentWithContext(ctx, &cloudantv1.PostDocumentOptions{
+		Db:       &c.DbName,
+		Document: document,
+	})
+	if err != nil {
+		return &CloudantError{Err: err}
+	}
+	c.streaksRev = result.Rev
+	return nil
+}
+
+// SaveHistory writes doc, replacing any earlier run's doc for the same
+// ingest date so reruns and backfills keep the latest counts
+func (c *CloudantHistoryStore) SaveHistory(ctx context.Context, doc HistoryDoc) error {
+	id := "history-" + doc.IngestDate
+	existing, response, err := c.Service.GetDocumentWithContext(ctx, &cloudantv1.GetDocumentOptions{
+		Db:    &c.DbName,
+		DocID: &id,
+	})
+	if err != nil && (response == nil || response.StatusCode != http.StatusNotFound) {
+		return &CloudantError{Err: err}
+	}
+	document := &cloudantv1.Document{ID: &id}
+	if err == nil {
+		document.Rev = existing.Rev
+	}
+	document.SetProperty("run_date", doc.RunDate)
+	document.SetProperty("ingest_date", doc.IngestDate)
+	if doc.IngestStart != "" {
+		document.SetProperty("ingest_start", doc.IngestStart)
+		document.SetProperty("ingest_end", doc.IngestEnd)
+	}
+	document.SetProperty("mag_data", doc.MagData)
+
+	_, _, err = c.Service.PostDocumentWithContext(ctx, &cloudantv1.PostDocumentOptions{
+		Db:       &c.DbName,
+		Document: document,
+	})
+	if err != nil {
+		return &CloudantError{Err: err}
+	}
+	return nil
+}
+
+func (c *CloudantHistoryStore) LoadHistory(ctx context.Context, ingestDates []string) ([]HistoryDoc, error) {
+	selector := map[string]interface{}{
+		"ingest_date": map[string]interface{}{
+			"$in": ingestDates,
+		},
+	}
+	findResult, _, err := c.Service.PostFindWithContext(ctx, &cloudantv1.PostFindOptions{
+		Db:       &c.DbName,
+		Selector: selector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []HistoryDoc
+	for _, doc := range findResult.Docs {
+		b, err := json.Marshal(doc.GetProperties())
+		if err != nil {
+			return nil, err
+		}
+		var historyDoc HistoryDoc
+		if err := json.Unmarshal(b, &historyDoc); err != nil {
+			logErrorf("Skipping history document %s: %s\n", docID(doc), err)
+			continue
+		}
+		docs = append(docs, historyDoc)
+	}
+	return docs, nil
+}
+
+// Recipients is who the daily report goes to
+type Recipients struct {
+	To  []string `json:"to"`
+	Cc  []string `json:"cc"`
+	Bcc []string `json:"bcc"`
+}
+
+// Lists returns the valid, deduped To, Cc and Bcc recipients
+func (r *Recipients) Lists() (to []BrevoTo, cc []BrevoTo, bcc []BrevoTo) {
+	toBrevo := func(emails []string) []BrevoTo {
+		var list []BrevoTo
+		for _, email := range emails {
+			list = append(list, BrevoTo{Email: strings.TrimSpace(email)})
+		}
+		return dedupeRecipients(filterRecipients(list))
+	}
+	return toBrevo(r.To), toBrevo(r.Cc), toBrevo(r.Bcc)
+}
+
+// RecipientStore is somewhere to manage the report recipients outside the
+// deployment. GetRecipients returns nil if there are none stored.
+type RecipientStore interface {
+	GetRecipients(ctx context.Context) (*Recipients, error)
+}
+
+// CloudantRecipientStore reads the recipients from a config document
+type CloudantRecipientStore struct {
+	Service *cloudantv1.CloudantV1
+	DbName  string
+	DocID   string
+}
+
+func (c *CloudantRecipientStore) GetRecipients(ctx context.Context) (*Recipients, error) {
+	doc, response, err := c.Service.GetDocumentWithContext(ctx, &cloudantv1.GetDocumentOptions{
+		Db:    &c.DbName,
+		DocID: &c.DocID,
+	})
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, &CloudantError{Err: err}
+	}
+	b, err := json.Marshal(doc.GetProperties())
+	if err != nil {
+		return nil, err
+	}
+	var recipients Recipients
+	if err := json.Unmarshal(b, &recipients); err != nil {
+		return nil, fmt.Errorf("error decoding recipients document %s: %s", c.DocID, err)
+	}
+	return &recipients, nil
+}
+
+// FileFeedStore loads the feed list from a local JSON file, either as a list
+// of Feeds or as a list of raw Cloudant publisher documents
+type FileFeedStore struct {
+	Path string
+
+	malformed []MalformedDoc
+}
+
+func (f *FileFeedStore) MalformedDocs() []MalformedDoc {
+	return f.malformed
+}
+
+func (f *FileFeedStore) GetFeeds(ctx context.Context) ([]Feed, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading feeds file %s: %s", f.Path, err)
+	}
+
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("error decoding feeds file %s: %s", f.Path, err)
+	}
+
+	var feeds []Feed
+	f.malformed = nil
+	if isCloudantDocs(raw) {
+		// Raw Cloudant document shape
+		docs := make([]cloudantv1.Document, 0, len(raw))
+		for _, m := range raw {
+			doc := cloudantv1.Document{}
+			if id, ok := m["_id"].(string); ok {
+				doc.ID = &id
+				delete(m, "_id")
+			}
+			doc.SetProperties(m)
+			docs = append(docs, doc)
+		}
+		feeds, f.malformed = ParseFeeds(docs)
+	} else {
+		if err := json.Unmarshal(b, &feeds); err != nil {
+			return nil, fmt.Errorf("error decoding feeds file %s: %s", f.Path, err)
+		}
+		for i, feed := range feeds {
+			if strings.TrimSpace(feed.FeedName) == "" {
+				return nil, fmt.Errorf("error decoding feeds file %s: entry %d has no feed_name", f.Path, i)
+			}
+		}
+	}
+
+	logf("Loaded %d feeds from %s\n", len(feeds), f.Path)
+	return feeds, nil
+}
+
+// isCloudantDocs reports whether a feeds file holds raw Cloudant publisher
+// documents rather than a list of feeds. Every entry is checked so a single
+// malformed document doesn't change how the whole file is read.
+func isCloudantDocs(raw []map[string]interface{}) bool {
+	for _, m := range raw {
+		_, hasFeeds := m["RSS_Feeds"]
+		_, hasPublisher := m["Publisher_Name"]
+		if hasFeeds || hasPublisher {
+			return true
+		}
+	}
+	return false
+}
+
+// Name is the feed name to show in the report
+func (f Feed) Name() string {
+	if f.DisplayName != "" {
+		return f.DisplayName
+	}
+	return f.FeedName
+}
+
+// NormalizeFeedName trims and collapses whitespace in a feed name, then folds
+// its case if caseFold is "lower" or "upper"
+func NormalizeFeedName(name string, caseFold string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	switch caseFold {
+	case "lower":
+		name = strings.ToLower(name)
+	case "upper":
+		name = strings.ToUpper(name)
+	}
+	return name
+}
+
+// NormalizeFeeds normalizes every feed name so DB lookups match consistently.
+// The whitespace-cleaned name is kept as the display name when case folding
+// changes it.
+func NormalizeFeeds(feeds []Feed, caseFold string) ([]Feed, error) {
+	if caseFold != "" && caseFold != "lower" && caseFold != "upper" {
+		return nil, fmt.Errorf("invalid feed_name_case: %q", caseFold)
+	}
+	for i, feed := range feeds {
+		normalized := NormalizeFeedName(feed.FeedName, caseFold)
+		if normalized == feed.FeedName {
+			continue
+		}
+		logf("Normalized feed name %q to %q\n", feed.FeedName, normalized)
+		if display := NormalizeFeedName(feed.FeedName, ""); display != normalized {
+			feeds[i].DisplayName = display
+		}
+		feeds[i].FeedName = normalized
+	}
+	return feeds, nil
+}
+
+// DedupeFeeds drops feeds with the same publisher and feed name, or the same
+// feed URL, as an earlier feed. Returns the deduped feeds and how many were
+// dropped.
+func DedupeFeeds(feeds []Feed) ([]Feed, int) {
+	seenNames := make(map[string]bool)
+	seenUrls := make(map[string]bool)
+	deduped := make([]Feed, 0, len(feeds))
+	for _, feed := range feeds {
+		nameKey := feed.Publisher + "\x00" + feed.FeedName
+		if seenNames[nameKey] || (feed.FeedUrl != "" && seenUrls[feed.FeedUrl]) {
+			continue
+		}
+		seenNames[nameKey] = true
+		if feed.FeedUrl != "" {
+			seenUrls[feed.FeedUrl] = true
+		}
+		deduped = append(deduped, feed)
+	}
+	return deduped, len(feeds) - len(deduped)
+}
+
+// SkipFeeds drops feeds whose name or publisher is in the skip lists,
+// ignoring case. Returns the remaining feeds and how many were skipped.
+func SkipFeeds(feeds []Feed, skipNames []string, skipPublishers []string) ([]Feed, int) {
+	if len(skipNames) == 0 && len(skipPublishers) == 0 {
+		return feeds, 0
+	}
+	skipName := make(map[string]bool)
+	for _, name := range skipNames {
+		skipName[strings.ToLower(name)] = true
+	}
+	skipPublisher := make(map[string]bool)
+	for _, publisher := range skipPublishers {
+		skipPublisher[strings.ToLower(publisher)] = true
+	}
+
+	kept := make([]Feed, 0, len(feeds))
+	for _, feed := range feeds {
+		if skipName[strings.ToLower(strings.TrimSpace(feed.FeedName))] ||
+			skipPublisher[strings.ToLower(strings.TrimSpace(feed.Publisher))] {
+			continue
+		}
+		kept = append(kept, feed)
+	}
+	return kept, len(feeds) - len(kept)
+}
+
+func ParseFeeds(docs []cloudantv1.Document) ([]Feed, []MalformedDoc) {
+	// Build slice of RSS Feeds, skipping and collecting any malformed documents
+	var feeds []Feed
+	var malformed []MalformedDoc
+	skip := func(doc cloudantv1.Document, reason string) {
+		logErrorf("Skipping document %s: %s\n", docID(doc), reason)
+		malformed = append(malformed, MalformedDoc{DocID: docID(doc), Error: reason})
+	}
+	for _, doc := range docs {
+		publisher, ok := doc.GetProperty("Publisher_Name").(string)
+		if !ok {
+			skip(doc, "Publisher_Name is missing or not a string")
+			continue
+		}
+		if doc.GetProperty("RSS_Feeds") == nil {
+			skip(doc, "RSS_Feeds is missing")
+			continue
+		}
+		var rssFeeds []RssFeed
+		b, err := json.Marshal(doc.GetProperty("RSS_Feeds"))
+		if err != nil {
+			skip(doc, fmt.Sprintf("error marshaling RSS_Feeds interface into JSON: %s", err))
+			continue
+		}
+		err = json.Unmarshal(b, &rssFeeds)
+		if err != nil {
+			skip(doc, fmt.Sprintf("error decoding RSS_Feeds JSON: %s", err))
+			continue
+		}
+		for _, rssfeed := range rssFeeds {
+			feed := Feed{
+				Publisher:       publisher,
+				FeedUrl:         rssfeed.RssFeedUrl,
+				FeedName:        rssfeed.RssFeedName,
+				LastUpdatedDate: rssfeed.LastUpdatedDate,
+				PauseReason:     rssfeed.PauseReason,
+				CreatedDate:     rssfeed.CreatedDate,
+			}
+			feeds = append(feeds, feed)
+		}
+	}
+	return feeds, malformed
+}
+
+func docID(doc cloudantv1.Document) string {
+	if doc.ID == nil {
+		return "<unknown>"
+	}
+	return *doc.ID
+}
+
+// Healthy reports whether the feed URL responded 2xx with XML content
+func (f FeedStatus) Healthy() bool {
+	return f.Err == nil && f.StatusCode/100 == 2 && f.IsXML
+}
+
+// String summarizes the status for the report
+func (f FeedStatus) String() string {
+	switch {
+	case f.Err != nil:
+		return "error: " + f.Err.Error()
+	case f.StatusCode/100 != 2:
+		return "http " + strconv.Itoa(f.StatusCode)
+	case !f.IsXML:
+		return "not xml"
+	}
+	return "ok"
+}
+
+// CheckFeedURLs GETs every feed URL in parallel, bounded by sem
+func CheckFeedURLs(ctx context.Context, feeds []Feed, sem chan struct{}, limiter *RateLimiter) []FeedStatus {
+	statuses := make([]FeedStatus, len(feeds))
+	wg := sync.WaitGroup{}
+	for i, feed := range feeds {
+		wg.Add(1)
+		go func(i int, feed Feed) {
+			defer wg.Done()
+			statuses[i] = FeedStatus{FeedName: feed.Name(), FeedUrl: feed.FeedUrl}
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				statuses[i].Err = ctx.Err()
+				return
+			}
+			host := ""
+			if u, err := url.Parse(feed.FeedUrl); err == nil {
+				host = u.Host
+			}
+			if err := limiter.Wait(ctx, host); err != nil {
+				statuses[i].Err = err
+				return
+			}
+			statuses[i] = CheckFeedURL(ctx, feed)
+		}(i, feed)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// RateLimiter spaces requests out to at most rps a second overall (a token
+// bucket holding one token) and at least hostInterval apart for any one
+// host. A rate of 0 is unlimited. A nil *RateLimiter never waits.
+type RateLimiter struct {
+	interval     time.Duration
+	hostInterval time.Duration
+
+	mu         sync.Mutex
+	next       time.Time
+	nextByHost map[string]time.Time
+}
+
+func NewRateLimiter(rps float64, hostInterval time.Duration) *RateLimiter {
+	limiter := &RateLimiter{hostInterval: hostInterval, nextByHost: make(map[string]time.Time)}
+	if rps > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / rps)
+	}
+	return limiter
+}
+
+// Wait blocks until a request to host is allowed, or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	at := time.Now()
+	if l.next.After(at) {
+		at = l.next
+	}
+	if hostNext := l.nextByHost[host]; host != "" && hostNext.After(at) {
+		at = hostNext
+	}
+	l.next = at.Add(l.interval)
+	if host != "" {
+		l.nextByHost[host] = at.Add(l.hostInterval)
+	}
+	l.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// CheckFeedURL GETs the feed URL and checks it looks like RSS/XML
+func CheckFeedURL(ctx context.Context, feed Feed) FeedStatus {
+	status := FeedStatus{FeedName: feed.Name(), FeedUrl: feed.FeedUrl}
+
+	ctx, cancel := context.WithTimeout(ctx, feedCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", feed.FeedUrl, nil)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer res.Body.Close()
+
+	status.StatusCode = res.StatusCode
+	if strings.Contains(res.Header.Get("Content-Type"), "xml") {
+		status.IsXML = true
+		return status
+	}
+
+	// Plenty of feeds are served as text/plain or octet-stream, so sniff
+	// the start of the body too
+	head, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	trimmed := strings.TrimSpace(string(head))
+	for _, prefix := range []string{"<?xml", "<rss", "<feed", "<rdf"} {
+		if strings.HasPrefix(trimmed, prefix) {
+			status.IsXML = true
+		}
+	}
+	return status
+}
+
+// Healthy reports whether every magazine ingested articles (or zero
+// ingestion is suppressed today, or the magazine is still new) and no DB
+// lookups failed
+func (r ReportData) Healthy() bool {
+	return (r.ZeroIngestion-r.ZeroInGrace == 0 || r.ZeroSuppressed) && r.FailedFeeds == 0
+}
+
+// ZeroAlertSuppressed reports whether runDate falls on one of dates, given
+// as 2006-01-02
+func ZeroAlertSuppressed(dates []string, runDate time.Time) (bool, error) {
+	today := runDate.Format("2006-01-02")
+	suppressed := false
+	for _, date := range dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return false, fmt.Errorf("%q is not a 2006-01-02 date", date)
+		}
+		if date == today {
+			suppressed = true
+		}
+	}
+	return suppressed, nil
+}
+
+// TriageReport marks the report subject and body so recipients can tell at a
+// glance whether they need to do anything
+func TriageReport(subject string, htmlContent string, healthy bool) (string, string) {
+	if !healthy {
+		return "⚠️ Action needed: " + subject, htmlContent
+	}
+	return "All feeds healthy: " + subject, insertIntoBody(htmlContent, "<p><b>All feeds healthy</b></p>")
+}
+
+// Uploader stores a report file where downstream consumers can pull it from,
+// returning its URL
+type Uploader interface {
+	Upload(ctx context.Context, key string, content []byte, contentType string) (string, error)
+}
+
+// S3Uploader PUTs objects into an S3-compatible bucket, given as a path-style
+// BaseURL (https://host/bucket), signing the requests with AWS Signature V4
+type S3Uploader struct {
+	BaseURL   string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3Uploader) Upload(ctx context.Context, key string, content []byte, contentType string) (string, error) {
+	var escapedKey []string
+	for _, segment := range strings.Split(key, "/") {
+		escapedKey = append(escapedKey, awsURIEscape(segment))
+	}
+	objectURL := strings.TrimSuffix(s.BaseURL, "/") + "/" + strings.Join(escapedKey, "/")
+	req, err := http.NewRequestWithContext(ctx, "PUT", objectURL, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, content, time.Now().UTC())
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("storage returned status %d: %s", res.StatusCode, body)
+	}
+	return objectURL, nil
+}
+
+// sign adds AWS Signature V4 headers to req
+func (s *S3Uploader) sign(req *http.Request, content []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(content)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// awsURIEscape percent-encodes everything but the unreserved characters, as
+// Signature V4 expects
+func awsURIEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// AttachmentsSize is the total base64-encoded size of the attachments
+func AttachmentsSize(attachments []BrevoAttachment) int {
+	size := 0
+	for _, attachment := range attachments {
+		size += len(attachment.Content)
+	}
+	return size
+}
+
+// TruncateReport keeps only the n magazines with the fewest articles, in
+// their original report order, and drops the extra sections
+func TruncateReport(report Report, n int) Report {
+	if len(report.Keys) <= n {
+		return report
+	}
+	worst := append([]string{}, report.Keys...)
+	sort.SliceStable(worst, func(i, j int) bool {
+		return report.MagData[worst[i]] < report.MagData[worst[j]]
+	})
+	keep := make(map[string]bool)
+	for _, key := range worst[:n] {
+		keep[key] = true
+	}
+	var keys []string
+	for _, key := range report.Keys {
+		if keep[key] {
+			keys = append(keys, key)
+		}
+	}
+	report.Keys = keys
+	report.StaleFeeds = nil
+	report.UnhealthyFeeds = nil
+	report.BelowExpected = nil
+	report.BaselineDrops = nil
+	report.PersistentFailures = nil
+	report.MalformedDocs = nil
+	return report
+}
+
+// insertIntoBody puts snippet at the start of the HTML body
+func insertIntoBody(htmlContent string, snippet string) string {
+	if i := strings.Index(htmlContent, "<body>"); i >= 0 {
+		i += len("<body>")
+		return htmlContent[:i] + snippet + htmlContent[i:]
+	}
+	return snippet + htmlContent
+}
+
+// appendToBody puts snippet at the end of the HTML body
+func appendToBody(htmlContent string, snippet string) string {
+	if i := strings.LastIndex(htmlContent, "</body>"); i >= 0 {
+		return htmlContent[:i] + snippet + htmlContent[i:]
+	}
+	return htmlContent + snippet
+}
+
+// maxFooterFailures is how many failed magazines the footer names before it
+// just gives the count
+const maxFooterFailures = 10
+
+// FooterHTML summarizes how many feeds were checked and failed, and the run ID
+func FooterHTML(checked int, failedMags []string, runID string) string {
+	var footer strings.Builder
+	footer.WriteString("<hr><p><small>")
+	fmt.Fprintf(&footer, "Feeds checked: %d. Feeds failed: %d", checked, len(failedMags))
+	if len(failedMags) > 0 && len(failedMags) <= maxFooterFailures {
+		names := make([]string, len(failedMags))
+		for i, mag := range failedMags {
+			names[i] = html.EscapeString(mag)
+		}
+		fmt.Fprintf(&footer, " (%s)", strings.Join(names, ", "))
+	}
+	fmt.Fprintf(&footer, ".<br>Run ID: %s</small></p>", html.EscapeString(runID))
+	return footer.String()
+}
+
+// GroupByPublisher splits the report's magazines into publishers, sorted by
+// name, keeping each publisher's magazines in report order
+func GroupByPublisher(mags []ReportMagazine) []PublisherGroup {
+	index := make(map[string]int)
+	var groups []PublisherGroup
+	for _, mag := range mags {
+		i, ok := index[mag.Publisher]
+		if !ok {
+			i = len(groups)
+			index[mag.Publisher] = i
+			groups = append(groups, PublisherGroup{Name: mag.Publisher})
+		}
+		groups[i].Subtotal += mag.Articles
+		groups[i].Magazines = append(groups[i].Magazines, mag)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// PublisherTableHTML renders the publisher groups as a table with a nested
+// table of magazines for each publisher
+func PublisherTableHTML(groups []PublisherGroup) string {
+	var b strings.Builder
+	b.WriteString(`<table border="1" cellpadding="4"><tr><th>Publisher</th><th>Magazines</th><th>Subtotal</th></tr>`)
+	for _, group := range groups {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td><table>", html.EscapeString(group.Name))
+		for _, mag := range group.Magazines {
+			fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td></tr>", mag.Link, FormatThousands(mag.Articles))
+		}
+		fmt.Fprintf(&b, "</table></td><td>%s</td></tr>", FormatThousands(group.Subtotal))
+	}
+	b.WriteString("</table>")
+	return b.String()
+}
+
+// MagazineTableHTML renders a table of each magazine, as its link, and its
+// article count
+func MagazineTableHTML(mags []ReportMagazine) string {
+	var b strings.Builder
+	b.WriteString(`<table border="1" cellpadding="4"><tr><th>Magazine</th><th>Articles</th></tr>`)
+	for _, mag := range mags {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td></tr>", mag.Link, FormatThousands(mag.Articles))
+	}
+	b.WriteString("</table>")
+	return b.String()
+}
+
+// SummaryHTML lists the headline numbers from the report
+func SummaryHTML(data ReportData) string {
+	return fmt.Sprintf("<p>%s articles ingested across %d magazines. %d magazines with no articles, %d failed DB lookups.</p>",
+		FormatThousands(data.TotalArticles), data.TotalMagazines, data.ZeroIngestion, data.FailedFeeds)
+}
+
+// ZeroIngestionPercent returns the percentage of magazines with no articles,
+// or 0 if there are no magazines
+func ZeroIngestionPercent(allMagData map[string]int) float64 {
+	if len(allMagData) == 0 {
+		return 0
+	}
+	zero := 0
+	for _, articles := range allMagData {
+		if articles == 0 {
+			zero++
+		}
+	}
+	return float64(zero) * 100 / float64(len(allMagData))
+}
+
+// FindBelowExpected returns the magazines, in report order, that ingested
+// fewer articles than their configured minimum, or defaultMin if they have none
+func FindBelowExpected(allMagData map[string]int, keys []string, minArticles map[string]int, defaultMin int) []BelowExpected {
+	var below []BelowExpected
+	for _, key := range keys {
+		min, ok := minArticles[key]
+		if !ok {
+			min = defaultMin
+		}
+		if allMagData[key] < min {
+			below = append(below, BelowExpected{Magazine: key, Articles: allMagData[key], MinArticles: min})
+		}
+	}
+	return below
+}
+
+// BaselineAverages returns each magazine's average daily articles across the
+// history docs, leaving out magazines in fewer than minDays of them
+func BaselineAverages(history []HistoryDoc, minDays int) map[string]float32 {
+	totals := make(map[string]int)
+	days := make(map[string]int)
+	for _, doc := range history {
+		for mag, articles := range doc.MagData {
+			totals[mag] += articles
+			days[mag]++
+		}
+	}
+	averages := make(map[string]float32)
+	for mag, total := range totals {
+		if days[mag] < minDays {
+			continue
+		}
+		averages[mag] = float32(total) / float32(days[mag])
+	}
+	return averages
+}
+
+// FindBaselineDrops returns the magazines, in report order, whose count is
+// below fraction of their baseline average. Magazines without a baseline are
+// skipped.
+func FindBaselineDrops(allMagData map[string]int, keys []string, baselines map[string]float32, fraction float32) []BaselineDrop {
+	var drops []BaselineDrop
+	for _, key := range keys {
+		baseline, ok := baselines[key]
+		if !ok || baseline == 0 {
+			continue
+		}
+		if float32(allMagData[key]) < baseline*fraction {
+			drops = append(drops, BaselineDrop{Magazine: key, Articles: allMagData[key], BaselineAvg: baseline})
+		}
+	}
+	return drops
+}
+
+// FindStaleFeeds returns the feeds whose LastUpdatedDate is more than
+// staleDays before now, along with any whose date can't be parsed
+func FindStaleFeeds(feeds []Feed, staleDays int, now time.Time) []StaleFeed {
+	var stale []StaleFeed
+	for _, feed := range feeds {
+		ageDays := -1
+		if updated, ok := parseFeedDate(feed.LastUpdatedDate); ok {
+			ageDays = int(now.Sub(updated).Hours() / 24)
+			if ageDays <= staleDays {
+				continue
+			}
+		}
+		stale = append(stale, StaleFeed{
+			FeedName:        feed.Name(),
+			Publisher:       feed.Publisher,
+			LastUpdatedDate: feed.LastUpdatedDate,
+			AgeDays:         ageDays,
+		})
+	}
+	return stale
+}
+
+// FindNewFeeds returns the names of feeds whose CreatedDate, read in now's
+// timezone, is within graceDays of now. Feeds without a CreatedDate are
+// never treated as new.
+func FindNewFeeds(feeds []Feed, graceDays int, now time.Time) map[string]bool {
+	newFeeds := make(map[string]bool)
+	for _, feed := range feeds {
+		for _, layout := range feedDateLayouts {
+			created, err := time.ParseInLocation(layout, feed.CreatedDate, now.Location())
+			if err != nil {
+				continue
+			}
+			if now.Sub(created) <= time.Duration(graceDays)*24*time.Hour {
+				newFeeds[feed.Name()] = true
+			}
+			break
+		}
+	}
+	return newFeeds
+}
+
+func parseFeedDate(date string) (time.Time, bool) {
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// CompressAttachment gzips content if it's over threshold bytes, returning
+// the bytes to attach and the matching file name. A threshold of 0 never
+// compresses.
+func CompressAttachment(content []byte, name string, threshold int) ([]byte, string, error) {
+	if threshold <= 0 || len(content) <= threshold {
+		return content, name, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), name + ".gz", nil
+}
+
+// BuildDetailCSV lists the retained articles for each magazine, in report order
+func BuildDetailCSV(articles map[string][]DBRow, keys []string, delimiter rune) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if delimiter != 0 {
+		w.Comma = delimiter
+	}
+
+	w.Write([]string{"magazine", "article_title", "article_publisher", "article_url", "article_pubdate"})
+	for _, key := range keys {
+		for _, row := range articles[key] {
+			record := []string{
+				key,
+				row.ArticleTitle,
+				row.ArticlePublisher,
+				row.ArticleUrl,
+				formatPubdate(row.ArticlePubdate),
+			}
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// JSONLRecord is one magazine's line in the JSON Lines export
+type JSONLRecord struct {
+	Magazine  string `json:"magazine"`
+	Articles  int    `json:"articles"`
+	Publisher string `json:"publisher"`
+	Failed    bool   `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// WriteJSONL writes one JSON object per feed result, sorted by magazine
+func WriteJSONL(w io.Writer, results []FeedResult) error {
+	sorted := append([]FeedResult{}, results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Magazine < sorted[j].Magazine
+	})
+	enc := json.NewEncoder(w)
+	for _, result := range sorted {
+		record := JSONLRecord{
+			Magazine:  result.Magazine,
+			Articles:  result.IngestedArticles,
+			Publisher: result.Publisher,
+			Failed:    result.Err != nil,
+		}
+		if result.Err != nil {
+			record.Error = result.Err.Error()
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatPubdate renders an article_pubdate epoch, in either seconds or
+// milliseconds, as a UTC date
+func formatPubdate(epoch int64) string {
+	if epoch <= 0 {
+		return "unknown"
+	}
+	// Anything this big in seconds would be thousands of years out, so it
+	// must be milliseconds
+	var t time.Time
+	if epoch > 1e11 {
+		t = time.UnixMilli(epoch)
+	} else {
+		t = time.Unix(epoch, 0)
+	}
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// BuildWeeklyTrend builds a CSV of the 7 days up to and including ingestDate,
+// using today's counts for the last day and the history store for the rest
+func BuildWeeklyTrend(ctx context.Context, store HistoryStore, ingestDate time.Time, today map[string]int, delimiter rune) ([]byte, error) {
+	labels := make([]string, 7)
+	for i := range labels {
+		labels[i] = ingestDate.AddDate(0, 0, i-6).Format("2006-01-02")
+	}
+
+	history, err := store.LoadHistory(ctx, labels[:6])
+	if err != nil {
+		return nil, err
+	}
+	byDate := make(map[string]map[string]int)
+	for _, doc := range history {
+		byDate[doc.IngestDate] = doc.MagData
+	}
+	days := make([]map[string]int, 7)
+	for i, label := range labels[:6] {
+		days[i] = byDate[label]
+	}
+	days[6] = today
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if delimiter != 0 {
+		w.Comma = delimiter
+	}
+	w.WriteAll(BuildTrendPivot(days, labels))
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// BuildTrendPivot lays out one row per magazine and one column per day.
+// A nil day, or a magazine missing from a day, is left blank.
+func BuildTrendPivot(days []map[string]int, labels []string) [][]string {
+	magSet := make(map[string]bool)
+	for _, day := range days {
+		for mag := range day {
+			magSet[mag] = true
+		}
+	}
+	mags := make([]string, 0, len(magSet))
+	for mag := range magSet {
+		mags = append(mags, mag)
+	}
+	sort.Strings(mags)
+
+	rows := [][]string{append([]string{"magazine"}, labels...)}
+	for _, mag := range mags {
+		row := []string{mag}
+		for _, day := range days {
+			if articles, ok := day[mag]; ok {
+				row = append(row, strconv.Itoa(articles))
+			} else {
+				row = append(row, "")
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func parseWeekday(day string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), day) {
+			return d, true
+		}
+	}
+	return time.Sunday, false
+}
+
+// sortKeys returns the magazines ordered by mode: count_asc (fewest articles
+// first), count_desc (most articles first) or name. Ties sort by name, in
+// ties order: asc (A-Z) or desc (Z-A).
+func sortKeys(allMagData map[string]int, mode string, ties string) ([]string, error) {
+	keys := make([]string, 0, len(allMagData))
+	for key := range allMagData {
+		keys = append(keys, key)
+	}
+	switch ties {
+	case "asc":
+		sort.Strings(keys)
+	case "desc":
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	default:
+		return nil, fmt.Errorf("unknown tie-break order %q", ties)
+	}
+
+	switch mode {
+	case "count_asc":
+		sort.SliceStable(keys, func(i, j int) bool {
+			return allMagData[keys[i]] < allMagData[keys[j]]
+		})
+	case "count_desc":
+		sort.SliceStable(keys, func(i, j int) bool {
+			return allMagData[keys[i]] > allMagData[keys[j]]
+		})
+	case "name":
+	default:
+		return nil, fmt.Errorf("unknown sort mode %q", mode)
+	}
+	return keys, nil
+}
+
+func BuildCSV(out io.Writer, report Report) error {
+	//Build CSV with article data
+	if report.BOM {
+		if _, err := out.Write([]byte("\xEF\xBB\xBF")); err != nil {
+			logErrorf("Failed to write BOM to file: %s\n", err)
+			return err
+		}
+	}
+
+	w := csv.NewWriter(out)
+	if report.Delimiter != 0 {
+		w.Comma = report.Delimiter
+	}
+
+	header := []string{"magazine", "articles"}
+	if report.Attempts != nil {
+		header = append(header, "attempts")
+	}
+	if report.GroupByPublisher {
+		header = append([]string{"publisher"}, header...)
+	}
+	w.Write(header)
+
+	// Pad a row out to the header, leaving the publisher column blank for
+	// rows that aren't about one publisher
+	padRow := func(row []string, publisher bool) []string {
+		if report.GroupByPublisher && !publisher {
+			row = append([]string{""}, row...)
+		}
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		return row
+	}
+
+	magazineRow := func(key string) []string {
+		row := []string{key, strconv.Itoa(report.MagData[key])}
+		if report.Attempts != nil {
+			row = append(row, strconv.Itoa(report.Attempts[key]))
+		}
+		return row
+	}
+
+	if report.GroupByPublisher {
+		// Keep each publisher's magazines in the report's sort order
+		groups := make(map[string][]string)
+		for _, key := range report.Keys {
+			publisher := report.Publishers[key]
+			groups[publisher] = append(groups[publisher], key)
+		}
+		publishers := make([]string, 0, len(groups))
+		for publisher := range groups {
+			publishers = append(publishers, publisher)
+		}
+		sort.Strings(publishers)
+
+		for _, publisher := range publishers {
+			subtotal := 0
+			for _, key := range groups[publisher] {
+				subtotal += report.MagData[key]
+				row := append([]string{publisher}, magazineRow(key)...)
+				if err := w.Write(row); err != nil {
+					logErrorf("Failed to write magazine to file: %s\n", err)
+					return err
+				}
+			}
+			row := padRow([]string{publisher, "SUBTOTAL", strconv.Itoa(subtotal)}, true)
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write publisher subtotal to file: %s\n", err)
+				return err
+			}
+		}
+	} else {
+		for _, key := range report.Keys {
+			if err := w.Write(magazineRow(key)); err != nil {
+				logErrorf("Failed to write magazine to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	total := 0
+	zeroCount := 0
+	for _, key := range report.Keys {
+		total += report.MagData[key]
+		if report.MagData[key] == 0 {
+			zeroCount++
+		}
+	}
+
+	// Summary rows so the recipient doesn't have to sum the column
+	summary := [][]string{
+		{"TOTAL", strconv.Itoa(total)},
+		{"ZERO_INGESTION_MAGAZINES", strconv.Itoa(zeroCount)},
+	}
+	for _, row := range summary {
+		if err := w.Write(padRow(row, false)); err != nil {
+			logErrorf("Failed to write summary to file: %s\n", err)
+			return err
+		}
+	}
+
+	// Separate section listing feeds that haven't been updated recently
+	if len(report.StaleFeeds) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"stale_feed", "publisher", "last_updated_date", "stale_days"})
+		for _, feed := range report.StaleFeeds {
+			staleDays := "unknown"
+			if feed.AgeDays >= 0 {
+				staleDays = strconv.Itoa(feed.AgeDays)
+			}
+			row := []string{feed.FeedName, feed.Publisher, feed.LastUpdatedDate, staleDays}
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write stale feed to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	// Separate section listing magazines under their expected volume
+	if len(report.BelowExpected) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"below_expected", "articles", "expected_min", "reason"})
+		for _, mag := range report.BelowExpected {
+			row := []string{mag.Magazine, strconv.Itoa(mag.Articles), strconv.Itoa(mag.MinArticles), "below expected"}
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write below expected magazine to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	// Separate section listing magazines well down on their baseline
+	if len(report.BaselineDrops) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"below_baseline", "articles", "baseline_avg"})
+		for _, mag := range report.BaselineDrops {
+			row := []string{mag.Magazine, strconv.Itoa(mag.Articles), strconv.FormatFloat(float64(mag.BaselineAvg), 'f', 1, 32)}
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write baseline drop to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	// Separate section listing feeds whose DB lookups keep failing
+	if len(report.PersistentFailures) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"persistently_failing", "failure_streak", "last_success"})
+		for _, fail := range report.PersistentFailures {
+			row := []string{fail.Magazine, strconv.Itoa(fail.FailureStreak), fail.LastSuccess}
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write persistent failure to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	// Separate section listing publisher documents that couldn't be parsed
+	if len(report.MalformedDocs) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"malformed_document", "error"})
+		for _, doc := range report.MalformedDocs {
+			if err := w.Write([]string{doc.DocID, doc.Error}); err != nil {
+				logErrorf("Failed to write malformed document to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	// Separate section listing feeds whose URL isn't serving a valid feed
+	if len(report.UnhealthyFeeds) > 0 {
+		w.Write([]string{})
+		w.Write([]string{"unhealthy_feed", "feed_url", "feed_status"})
+		for _, feed := range report.UnhealthyFeeds {
+			row := []string{feed.FeedName, feed.FeedUrl, feed.String()}
+			if err := w.Write(row); err != nil {
+				logErrorf("Failed to write unhealthy feed to file: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// Static parts of the xlsx package. Style 1 is the bold header font and dxf 0
+// is the highlight used for zero-ingestion rows.
+const xlsxMIMEType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+</Types>`
+
+const xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Articles" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>
+<dxfs count="1"><dxf><font><color rgb="FF9C0006"/></font><fill><patternFill><bgColor rgb="FFFFC7CE"/></patternFill></fill></dxf></dxfs>
+</styleSheet>`
+
+// buildXLSX builds a spreadsheet of the magazine/articles columns with a
+// frozen bold header row and zero-ingestion rows highlighted
+func buildXLSX(allMagData map[string]int, keys []string) ([]byte, error) {
+	var sheet strings.Builder
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>
+<sheetData>
+<row r="1"><c r="A1" t="inlineStr" s="1"><is><t>magazine</t></is></c><c r="B1" t="inlineStr" s="1"><is><t>articles</t></is></c></row>
+`)
+	for i, key := range keys {
+		r := i + 2
+		fmt.Fprintf(&sheet, `<row r="%d"><c r="A%d" t="inlineStr"><is><t>%s</t></is></c><c r="B%d"><v>%d</v></c></row>`+"\n",
+			r, r, html.EscapeString(key), r, allMagData[key])
+	}
+	sheet.WriteString("</sheetData>\n")
+	if len(keys) > 0 {
+		fmt.Fprintf(&sheet, `<conditionalFormatting sqref="A2:B%d"><cfRule type="expression" dxfId="0" priority="1"><formula>$B2=0</formula></cfRule></conditionalFormatting>`+"\n",
+			len(keys)+1)
+	}
+	sheet.WriteString("</worksheet>")
+
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+		{"xl/worksheets/sheet1.xml", sheet.String()},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
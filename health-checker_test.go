@@ -0,0 +1,3070 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/cloudant-go-sdk/cloudantv1"
+)
+
+// fakeBrevo records the emails sent to it and answers account lookups
+type fakeBrevo struct {
+	*httptest.Server
+	Status int // if set, every request gets this status
+
+	mu      sync.Mutex
+	emails  []BrevoQuery
+	headers []http.Header
+}
+
+func newFakeBrevo(t *testing.T) *fakeBrevo {
+	b := &fakeBrevo{}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	t.Setenv("brevo_base_url", b.URL)
+	t.Setenv("brevo_api_key", "test-key")
+	return b
+}
+
+func (b *fakeBrevo) serve(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.headers = append(b.headers, r.Header.Clone())
+	if b.Status != 0 {
+		writeJSON(w, b.Status, map[string]string{"message": "forced by test"})
+		return
+	}
+	switch r.URL.Path {
+	case "/account":
+		writeJSON(w, http.StatusOK, map[string]string{"email": "sender@example.com"})
+	case "/smtp/email":
+		var query BrevoQuery
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.emails = append(b.emails, query)
+		writeJSON(w, http.StatusCreated, map[string]string{"messageId": "<1@example.com>"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (b *fakeBrevo) sent() []BrevoQuery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BrevoQuery{}, b.emails...)
+}
+
+// lastEmail returns the most recent email, failing the test if there's none
+func (b *fakeBrevo) lastEmail(t *testing.T) BrevoQuery {
+	t.Helper()
+	emails := b.sent()
+	if len(emails) == 0 {
+		t.Fatal("no email sent")
+	}
+	return emails[len(emails)-1]
+}
+
+// fakeDB answers article lookups like the real DB, with Counts rows for each
+// magazine, and records every query
+type fakeDB struct {
+	*httptest.Server
+	Counts map[string]int
+	Omit   map[string]bool // left out of batch responses
+	Broken map[string]bool // answered with invalid JSON
+	Status int             // if set, every lookup gets this status
+
+	mu    sync.Mutex
+	paths []string
+	query []url.Values
+}
+
+func newFakeDB(t *testing.T, counts map[string]int) *fakeDB {
+	d := &fakeDB{Counts: counts}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *fakeDB) serve(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	d.paths = append(d.paths, r.URL.Path)
+	d.query = append(d.query, r.URL.Query())
+	d.mu.Unlock()
+	if d.Status != 0 {
+		w.WriteHeader(d.Status)
+		return
+	}
+	fixture := &FixtureTransport{Counts: d.Counts}
+	query := r.URL.Query()
+	var payload interface{}
+	if query.Has("magazines") {
+		batch := map[string]interface{}{}
+		for _, magazine := range strings.Split(query.Get("magazines"), ",") {
+			if !d.Omit[magazine] {
+				batch[magazine] = fixture.payload(magazine)
+			}
+		}
+		payload = batch
+	} else {
+		magazine := query.Get("magazine")
+		if d.Broken[magazine] {
+			fmt.Fprint(w, "not json")
+			return
+		}
+		payload = fixture.payload(magazine)
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// BaseURL is the DB URL as validateConfig would normalize it
+func (d *fakeDB) BaseURL() string {
+	return d.URL + "/"
+}
+
+func (d *fakeDB) queries() []url.Values {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]url.Values{}, d.query...)
+}
+
+// fakeCloudant serves the parts of the Cloudant API the health checker uses:
+// _find over the publisher docs (paged by bookmark) or history docs, and
+// getting and saving documents
+type fakeCloudant struct {
+	*httptest.Server
+	Feeds []map[string]interface{} // publisher docs
+
+	mu     sync.Mutex
+	delay  time.Duration                                // before answering each request
+	status int                                          // if set, every request gets this status
+	docs   map[string]map[string]map[string]interface{} // db -> id -> doc
+	finds  []map[string]interface{}
+	revs   int
+}
+
+func newFakeCloudant(t *testing.T) *fakeCloudant {
+	c := &fakeCloudant{docs: make(map[string]map[string]map[string]interface{})}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	t.Cleanup(c.Close)
+	t.Setenv("CLOUDANT_URL", c.URL)
+	t.Setenv("CLOUDANT_AUTH_TYPE", "noauth")
+	return c
+}
+
+func (c *fakeCloudant) service(t *testing.T) *cloudantv1.CloudantV1 {
+	t.Helper()
+	service, err := cloudantv1.NewCloudantV1UsingExternalConfig(&cloudantv1.CloudantV1Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func (c *fakeCloudant) put(db string, doc map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.docs[db] == nil {
+		c.docs[db] = make(map[string]map[string]interface{})
+	}
+	c.revs++
+	doc["_rev"] = fmt.Sprintf("%d-fake", c.revs)
+	c.docs[db][doc["_id"].(string)] = doc
+}
+
+func (c *fakeCloudant) doc(db string, id string) map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.docs[db][id]
+}
+
+// SetDelay makes every request wait d before it's answered
+func (c *fakeCloudant) SetDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay = d
+}
+
+// SetStatus answers every request with status, or serves normally if it's 0
+func (c *fakeCloudant) SetStatus(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+func (c *fakeCloudant) serve(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	delay, status := c.delay, c.status
+	c.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+	if status != 0 {
+		writeJSON(w, status, map[string]string{"error": "forced", "reason": "forced by test"})
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	var req map[string]interface{}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	db := parts[0]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "_find":
+		c.find(w, db, req)
+	case r.Method == "GET" && len(parts) == 2:
+		doc, ok := c.docs[db][parts[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+	case r.Method == "POST" && len(parts) == 1:
+		id, _ := req["_id"].(string)
+		if existing, ok := c.docs[db][id]; ok && req["_rev"] != existing["_rev"] {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "conflict", "reason": "Document update conflict."})
+			return
+		}
+		if c.docs[db] == nil {
+			c.docs[db] = make(map[string]map[string]interface{})
+		}
+		c.revs++
+		req["_rev"] = fmt.Sprintf("%d-fake", c.revs)
+		c.docs[db][id] = req
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": req["_rev"]})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *fakeCloudant) find(w http.ResponseWriter, db string, req map[string]interface{}) {
+	c.finds = append(c.finds, req)
+	selector, _ := req["selector"].(map[string]interface{})
+	if dates, ok := selector["ingest_date"].(map[string]interface{}); ok {
+		want := make(map[string]bool)
+		in, _ := dates["$in"].([]interface{})
+		for _, date := range in {
+			want[fmt.Sprint(date)] = true
+		}
+		docs := []interface{}{}
+		for _, doc := range c.docs[db] {
+			if want[fmt.Sprint(doc["ingest_date"])] {
+				docs = append(docs, doc)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"docs": docs})
+		return
+	}
+
+	start := 0
+	if bookmark, ok := req["bookmark"].(string); ok {
+		start, _ = strconv.Atoi(bookmark)
+	}
+	end := len(c.Feeds)
+	if limit, ok := req["limit"].(float64); ok && start+int(limit) < end {
+		end = start + int(limit)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"docs":     c.Feeds[start:end],
+		"bookmark": strconv.Itoa(end),
+	})
+}
+
+func (c *fakeCloudant) findRequests() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]map[string]interface{}{}, c.finds...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONFile(t *testing.T, name string, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// memHistoryStore is a HistoryStore kept in memory
+type memHistoryStore struct {
+	docs    map[string]HistoryDoc
+	streaks map[string]FeedStreak
+	loaded  []string
+}
+
+func (m *memHistoryStore) SaveHistory(ctx context.Context, doc HistoryDoc) error {
+	m.docs[doc.IngestDate] = doc
+	return nil
+}
+
+func (m *memHistoryStore) LoadHistory(ctx context.Context, ingestDates []string) ([]HistoryDoc, error) {
+	m.loaded = ingestDates
+	var docs []HistoryDoc
+	for _, date := range ingestDates {
+		if doc, ok := m.docs[date]; ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (m *memHistoryStore) LoadStreaks(ctx context.Context) (map[string]FeedStreak, error) {
+	return m.streaks, nil
+}
+
+func (m *memHistoryStore) SaveStreaks(ctx context.Context, streaks map[string]FeedStreak) error {
+	m.streaks = streaks
+	return nil
+}
+
+// flakyFeedStore fails with Err for the first Failures calls
+type flakyFeedStore struct {
+	Failures int
+	Err      error
+	calls    int
+}
+
+func (f *flakyFeedStore) GetFeeds(ctx context.Context) ([]Feed, error) {
+	f.calls++
+	if f.calls <= f.Failures {
+		return nil, f.Err
+	}
+	return []Feed{{FeedName: "Mag A"}}, nil
+}
+
+// fakeClock jumps straight to whatever time the scheduler waits for, until
+// ctx is cancelled
+type fakeClock struct {
+	ctx context.Context
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// panicTransport panics on DB lookups for Magazine and passes everything
+// else through
+type panicTransport struct {
+	Magazine string
+}
+
+func (p panicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("magazine") == p.Magazine {
+		panic("boom")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stdout, fn)
+}
+
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stderr, fn)
+}
+
+// captureFile returns what fn writes to *file, which is swapped for a pipe
+// while it runs
+func captureFile(t *testing.T, file **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := *file
+	*file = w
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	fn()
+	*file = orig
+	w.Close()
+	return <-done
+}
+
+// summaryLine decodes the RunSummary printed among the run's output
+func summaryLine(t *testing.T, output string) RunSummary {
+	t.Helper()
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, `{"run_id"`) {
+			var summary RunSummary
+			if err := json.Unmarshal([]byte(line), &summary); err != nil {
+				t.Fatal(err)
+			}
+			return summary
+		}
+	}
+	t.Fatalf("no summary in output:\n%s", output)
+	return RunSummary{}
+}
+
+func csvRows(t *testing.T, b []byte) [][]string {
+	t.Helper()
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func attachmentRows(t *testing.T, attachment BrevoAttachment) [][]string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(attachment.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csvRows(t, b)
+}
+
+func findRow(rows [][]string, first string) []string {
+	for _, row := range rows {
+		if len(row) > 0 && row[0] == first {
+			return row
+		}
+	}
+	return nil
+}
+
+func testFeeds(names ...string) []Feed {
+	feeds := make([]Feed, len(names))
+	for i, name := range names {
+		feeds[i] = Feed{Publisher: "Pub", FeedName: name, FeedUrl: "https://feeds.example/" + url.PathEscape(name)}
+	}
+	return feeds
+}
+
+// setupRun points run at a feeds file, a fake DB and a fake Brevo, with the
+// report going to a single test address
+func setupRun(t *testing.T, feeds []Feed, counts map[string]int) (*fakeDB, *fakeBrevo) {
+	t.Helper()
+	t.Setenv("feeds_file", writeJSONFile(t, "feeds.json", feeds))
+	t.Setenv("email_address", "ops@example.com")
+	t.Setenv("last_run_file", filepath.Join(t.TempDir(), "last_run.json"))
+	return newFakeDB(t, counts), newFakeBrevo(t)
+}
+
+func runAgainst(db *fakeDB) error {
+	return run(context.Background(), &Config{DBURLs: []string{db.BaseURL()}})
+}
+
+func newTestCert(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "health-checker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func publisherDoc(id string, publisher interface{}, feeds interface{}) cloudantv1.Document {
+	doc := cloudantv1.Document{ID: &id}
+	if publisher != nil {
+		doc.SetProperty("Publisher_Name", publisher)
+	}
+	doc.SetProperty("RSS_Feeds", feeds)
+	return doc
+}
+
+func TestParseFeeds(t *testing.T) {
+	docs := []cloudantv1.Document{
+		publisherDoc("good", "Pub A", []interface{}{
+			map[string]interface{}{"RSS_Feed_Name": "Mag A", "RSS_Feed_URL": "https://a.example/rss", "Last_Updated_Date": "2024-03-01", "Pause_Reason": "moved", "Created_Date": "2023-01-01"},
+		}),
+		publisherDoc("numeric", 12345, []interface{}{}),
+		publisherDoc("missing", nil, []interface{}{}),
+		publisherDoc("bad-feeds", "Pub B", "not a list"),
+	}
+	feeds, malformed := ParseFeeds(docs)
+
+	want := []Feed{{Publisher: "Pub A", FeedName: "Mag A", FeedUrl: "https://a.example/rss", LastUpdatedDate: "2024-03-01", PauseReason: "moved", CreatedDate: "2023-01-01"}}
+	if !reflect.DeepEqual(feeds, want) {
+		t.Errorf("feeds = %+v, want %+v", feeds, want)
+	}
+	var ids []string
+	for _, doc := range malformed {
+		ids = append(ids, doc.DocID)
+	}
+	if want := []string{"numeric", "missing", "bad-feeds"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("malformed = %v, want %v", ids, want)
+	}
+	if !strings.Contains(malformed[0].Error, "Publisher_Name") {
+		t.Errorf("malformed[0].Error = %q, want it to mention Publisher_Name", malformed[0].Error)
+	}
+}
+
+func TestBuildCSVTotals(t *testing.T) {
+	var buf bytes.Buffer
+	err := BuildCSV(&buf, Report{
+		MagData: map[string]int{"A": 3, "B": 0, "C": 4},
+		Keys:    []string{"B", "A", "C"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"magazine", "articles"},
+		{"B", "0"},
+		{"A", "3"},
+		{"C", "4"},
+		{"TOTAL", "7"},
+		{"ZERO_INGESTION_MAGAZINES", "1"},
+	}
+	if rows := csvRows(t, buf.Bytes()); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+}
+
+func TestRunFullReport(t *testing.T) {
+	feeds := testFeeds("Mag A", "Mag B", "Mag C")
+	db, brevo := setupRun(t, feeds, map[string]int{"Mag A": 3, "Mag B": 0, "Mag C": 4})
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+
+	email := brevo.lastEmail(t)
+	want := [][]string{
+		{"magazine", "articles"},
+		{"Mag B", "0"},
+		{"Mag A", "3"},
+		{"Mag C", "4"},
+		{"TOTAL", "7"},
+		{"ZERO_INGESTION_MAGAZINES", "1"},
+	}
+	if rows := attachmentRows(t, email.Attachment[0]); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+	if want := "RSS Feed Health Status — 7 articles, 33% with no articles"; email.Subject != want {
+		t.Errorf("subject = %q, want %q", email.Subject, want)
+	}
+	if want := []BrevoTo{{Email: "david.mullen.085@gmail.com"}, {Email: "ops@example.com"}}; !reflect.DeepEqual(email.To, want) {
+		t.Errorf("To = %v, want %v", email.To, want)
+	}
+	if !strings.Contains(email.HtmlContent, "Feeds checked: 3. Feeds failed: 0") {
+		t.Errorf("body = %q, want the footer", email.HtmlContent)
+	}
+	if email.Headers["X-Run-ID"] != runID {
+		t.Errorf("X-Run-ID = %q, want %q", email.Headers["X-Run-ID"], runID)
+	}
+
+	for _, query := range db.queries() {
+		if query.Get("ingestdate") != time.Now().UTC().Add(-24*time.Hour).Format("2006-1-2") {
+			t.Errorf("query = %v, want yesterday's ingestdate", query)
+		}
+	}
+	if db.paths[0] != "/v2/get-article-by-ingestdate-magazine" {
+		t.Errorf("path = %q, want the default article path", db.paths[0])
+	}
+}
+
+func TestFileFeedStore(t *testing.T) {
+	feeds := testFeeds("Mag A", "Mag B")
+	store := &FileFeedStore{Path: writeJSONFile(t, "feeds.json", feeds)}
+	got, err := store.GetFeeds(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, feeds) {
+		t.Errorf("GetFeeds = %+v, want %+v", got, feeds)
+	}
+
+	// Raw Cloudant publisher documents, one of them malformed
+	store = &FileFeedStore{Path: writeJSONFile(t, "docs.json", []map[string]interface{}{
+		{"_id": "p1", "Publisher_Name": "Pub", "RSS_Feeds": []map[string]string{{"RSS_Feed_Name": "Mag A"}}},
+		{"_id": "p2", "Publisher_Name": 7, "RSS_Feeds": []map[string]string{}},
+	})}
+	got, err = store.GetFeeds(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].FeedName != "Mag A" || got[0].Publisher != "Pub" {
+		t.Errorf("GetFeeds = %+v, want Mag A from Pub", got)
+	}
+	if malformed := store.MalformedDocs(); len(malformed) != 1 || malformed[0].DocID != "p2" {
+		t.Errorf("MalformedDocs = %+v, want p2", malformed)
+	}
+
+	if _, err := (&FileFeedStore{Path: filepath.Join(t.TempDir(), "missing.json")}).GetFeeds(context.Background()); err == nil {
+		t.Error("GetFeeds of a missing file succeeded")
+	}
+}
+
+func TestFileFeedStoreDetectsDocsPastTheFirst(t *testing.T) {
+	store := &FileFeedStore{Path: writeJSONFile(t, "docs.json", []map[string]interface{}{
+		{"_id": "p1", "Publisher_Name": "Pub"},
+		{"_id": "p2", "Publisher_Name": "Pub", "RSS_Feeds": []map[string]string{{"RSS_Feed_Name": "Mag A"}}},
+	})}
+	feeds, err := store.GetFeeds(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 1 || feeds[0].FeedName != "Mag A" {
+		t.Errorf("GetFeeds = %+v, want Mag A", feeds)
+	}
+	if malformed := store.MalformedDocs(); len(malformed) != 1 || malformed[0].DocID != "p1" {
+		t.Errorf("MalformedDocs = %+v, want p1", malformed)
+	}
+
+	store = &FileFeedStore{Path: writeJSONFile(t, "feeds.json", []map[string]string{{"feed_name": "Mag A"}, {"publisher": "Pub"}})}
+	if _, err := store.GetFeeds(context.Background()); err == nil || !strings.Contains(err.Error(), "entry 1 has no feed_name") {
+		t.Errorf("GetFeeds = %v, want an error for the nameless feed", err)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	data := ReportData{ProgramName: "RSS", RunDate: "2024-3-5", TotalArticles: 12345, ZeroPercent: 25}
+	subject, err := RenderTemplate("subject", defaultReportSubjectTemplate, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "RSS Feed Health Status — 12,345 articles, 25% with no articles"; subject != want {
+		t.Errorf("subject = %q, want %q", subject, want)
+	}
+	name, err := RenderTemplate("name", defaultAttachmentNameTemplate, data)
+	if err != nil || name != "daily_article_data_2024-3-5" {
+		t.Errorf("name = %q, %v", name, err)
+	}
+	if _, err := RenderTemplate("bad", "{{.Missing", data); err == nil {
+		t.Error("RenderTemplate of a bad template succeeded")
+	}
+	if _, err := RenderTemplate("bad", "{{.Missing}}", data); err == nil {
+		t.Error("RenderTemplate of an unknown field succeeded")
+	}
+}
+
+func TestSendBrevoEmailErrors(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	ctx := context.Background()
+
+	if err := SendBrevoEmail(ctx, httpClient, BrevoQuery{To: []BrevoTo{{Email: "bad"}}}); err == nil {
+		t.Error("sending with no valid recipients succeeded")
+	}
+	err := SendBrevoEmail(ctx, httpClient, BrevoQuery{
+		To:         []BrevoTo{{Email: "a@example.com"}},
+		Attachment: []BrevoAttachment{{Name: "empty.csv"}},
+	})
+	if err == nil {
+		t.Error("sending an empty attachment succeeded")
+	}
+	err = SendBrevoEmail(ctx, httpClient, BrevoQuery{
+		To:     []BrevoTo{{Email: "a@example.com"}},
+		Params: map[string]interface{}{"bad": func() {}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "error encoding Brevo payload") {
+		t.Errorf("err = %v, want an encoding error", err)
+	}
+
+	brevo.Status = http.StatusBadRequest
+	err = SendBrevoEmail(ctx, httpClient, BrevoQuery{To: []BrevoTo{{Email: "a@example.com"}}})
+	var brevoErr *BrevoError
+	if !errors.As(err, &brevoErr) {
+		t.Errorf("err = %v, want a BrevoError", err)
+	}
+	if len(brevo.sent()) != 0 {
+		t.Errorf("sent %d emails, want none", len(brevo.sent()))
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"ops@example.com", true},
+		{"first.last+tag@sub.example.co.uk", true},
+		{"", false},
+		{"ops", false},
+		{"ops@", false},
+		{"Ops <ops@example.com>", false},
+		{"<ops@example.com>", false},
+		{" ops@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validateEmail(tt.email); got != tt.want {
+			t.Errorf("validateEmail(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestRunFailureAlert(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B", "C"), map[string]int{"A": 1})
+	db.Broken = map[string]bool{"B": true, "C": true}
+	t.Setenv("db_failure_alert_threshold", "1")
+	t.Setenv("ops_email_addresses", "oncall@example.com")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	emails := brevo.sent()
+	if len(emails) != 2 {
+		t.Fatalf("sent %d emails, want the alert and the report", len(emails))
+	}
+	alert := emails[0]
+	if alert.Subject != "RSS Feed Health Check: 2 DB lookups failed" || alert.To[0].Email != "oncall@example.com" {
+		t.Errorf("alert = %q to %v", alert.Subject, alert.To)
+	}
+	if !strings.Contains(alert.HtmlContent, "<li>B</li>") || !strings.Contains(alert.HtmlContent, "<li>C</li>") {
+		t.Errorf("alert body = %q, want B and C listed", alert.HtmlContent)
+	}
+	if !strings.Contains(emails[1].HtmlContent, "Feeds failed: 2") {
+		t.Errorf("report body = %q, want the failures in the footer", emails[1].HtmlContent)
+	}
+}
+
+func TestSendFailureAlertWithoutRecipients(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	t.Setenv("ops_email_addresses", "")
+	if err := SendFailureAlert(context.Background(), httpClient, []string{"A"}, errors.New("down")); err != nil {
+		t.Errorf("SendFailureAlert with no recipients = %v, want nil", err)
+	}
+	if n := len(brevo.sent()); n != 0 {
+		t.Errorf("sent %d emails, want none", n)
+	}
+}
+
+func TestRunLogsCarryRunID(t *testing.T) {
+	db, _ := setupRun(t, testFeeds("A", "B"), map[string]int{"A": 1})
+	db.Broken = map[string]bool{"B": true}
+	var stdout string
+	stderr := captureStderr(t, func() {
+		stdout = captureStdout(t, func() {
+			if err := runAgainst(db); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	if stderr == "" {
+		t.Fatal("nothing logged to stderr, want B's failure")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stdout+stderr), "\n") {
+		if !strings.HasPrefix(line, "run_id="+runID+" ") {
+			t.Errorf("log line %q has no run ID", line)
+		}
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B", "C"), map[string]int{"A": 1})
+	db.Broken = map[string]bool{"B": true, "C": true}
+	t.Setenv("db_failure_alert_threshold", "1")
+	t.Setenv("ops_email_addresses", "oncall@example.com")
+	t.Setenv("dry_run", "true")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(brevo.sent()); n != 0 {
+		t.Errorf("sent %d emails in a dry run, want none", n)
+	}
+}
+
+func TestFindStaleFeeds(t *testing.T) {
+	now := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	stale := FindStaleFeeds([]Feed{
+		{FeedName: "old", LastUpdatedDate: "2024-03-01"},
+		{FeedName: "fresh", LastUpdatedDate: "2024-03-08T10:00:00Z"},
+		{FeedName: "garbage", LastUpdatedDate: "whenever"},
+	}, 7, now)
+	if len(stale) != 2 || stale[0].AgeDays != 9 || stale[1].AgeDays != -1 {
+		t.Errorf("FindStaleFeeds = %+v", stale)
+	}
+}
+
+func TestCheckFeedURLs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, "<rss></rss>")
+		case "/sniffed":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "  <?xml version=\"1.0\"?><feed></feed>")
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	feeds := []Feed{
+		{FeedName: "rss", FeedUrl: srv.URL + "/rss"},
+		{FeedName: "sniffed", FeedUrl: srv.URL + "/sniffed"},
+		{FeedName: "html", FeedUrl: srv.URL + "/html"},
+		{FeedName: "missing", FeedUrl: srv.URL + "/missing"},
+		{FeedName: "bad", FeedUrl: "::"},
+	}
+	statuses := CheckFeedURLs(context.Background(), feeds, make(chan struct{}, 2), NewRateLimiter(0, 0))
+	want := []string{"ok", "ok", "not xml", "http 404", "error"}
+	for i, status := range statuses {
+		if status.FeedName != feeds[i].FeedName || !strings.HasPrefix(status.String(), want[i]) {
+			t.Errorf("%s = %s, want %s", feeds[i].FeedName, status, want[i])
+		}
+		if status.Healthy() != (want[i] == "ok") {
+			t.Errorf("%s Healthy() = %v", feeds[i].FeedName, status.Healthy())
+		}
+	}
+}
+
+func TestBuildCSVGroupByPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	err := BuildCSV(&buf, Report{
+		MagData:          map[string]int{"A": 1, "B": 2, "C": 3},
+		Keys:             []string{"A", "B", "C"},
+		Publishers:       map[string]string{"A": "Zed", "B": "Acme", "C": "Zed"},
+		Attempts:         map[string]int{"A": 1, "B": 2, "C": 1},
+		GroupByPublisher: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"publisher", "magazine", "articles", "attempts"},
+		{"Acme", "B", "2", "2"},
+		{"Acme", "SUBTOTAL", "2", ""},
+		{"Zed", "A", "1", "1"},
+		{"Zed", "C", "3", "1"},
+		{"Zed", "SUBTOTAL", "4", ""},
+		{"", "TOTAL", "6", ""},
+		{"", "ZERO_INGESTION_MAGAZINES", "0", ""},
+	}
+	if rows := csvRows(t, buf.Bytes()); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+}
+
+func TestGroupByPublisher(t *testing.T) {
+	groups := GroupByPublisher([]ReportMagazine{
+		{Name: "A", Publisher: "Zed", Articles: 1},
+		{Name: "B", Publisher: "Acme", Articles: 2},
+		{Name: "C", Publisher: "Zed", Articles: 3},
+	})
+	if len(groups) != 2 || groups[0].Name != "Acme" || groups[1].Name != "Zed" {
+		t.Fatalf("groups = %+v, want Acme then Zed", groups)
+	}
+	if groups[1].Subtotal != 4 || groups[1].Magazines[0].Name != "A" || groups[1].Magazines[1].Name != "C" {
+		t.Errorf("Zed = %+v, want A then C with subtotal 4", groups[1])
+	}
+
+	html := PublisherTableHTML([]PublisherGroup{{Name: "R&D", Subtotal: 1500, Magazines: []ReportMagazine{{Link: "Mag", Articles: 1500}}}})
+	for _, want := range []string{"<td>R&amp;D</td>", "<td>Mag</td><td>1,500</td>", "<td>1,500</td></tr></table>"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("PublisherTableHTML = %q, want it to contain %q", html, want)
+		}
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	data := map[string]int{"b": 1, "a": 1, "c": 0, "d": 5}
+	tests := []struct {
+		mode, ties string
+		want       []string
+	}{
+		{"count_asc", "asc", []string{"c", "a", "b", "d"}},
+		{"count_asc", "desc", []string{"c", "b", "a", "d"}},
+		{"count_desc", "asc", []string{"d", "a", "b", "c"}},
+		{"count_desc", "desc", []string{"d", "b", "a", "c"}},
+		{"name", "asc", []string{"a", "b", "c", "d"}},
+		{"name", "desc", []string{"d", "c", "b", "a"}},
+	}
+	for _, tt := range tests {
+		got, err := sortKeys(data, tt.mode, tt.ties)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortKeys(%s, %s) = %v, %v, want %v", tt.mode, tt.ties, got, err, tt.want)
+		}
+	}
+	if _, err := sortKeys(data, "random", "asc"); err == nil {
+		t.Error("sortKeys with an unknown mode succeeded")
+	}
+	if _, err := sortKeys(data, "name", "sideways"); err == nil {
+		t.Error("sortKeys with an unknown tie order succeeded")
+	}
+}
+
+func TestRetryFeedStore(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyFeedStore{Failures: 2, Err: errors.New("temporary")}
+	feeds, err := (&RetryFeedStore{Store: flaky, MaxRetries: 3}).GetFeeds(ctx)
+	if err != nil || len(feeds) != 1 || flaky.calls != 3 {
+		t.Errorf("GetFeeds = %v, %v after %d calls, want success on the 3rd", feeds, err, flaky.calls)
+	}
+
+	flaky = &flakyFeedStore{Failures: 5, Err: errors.New("temporary")}
+	if _, err := (&RetryFeedStore{Store: flaky, MaxRetries: 3}).GetFeeds(ctx); err == nil || flaky.calls != 3 {
+		t.Errorf("GetFeeds = %v after %d calls, want an error after 3", err, flaky.calls)
+	}
+
+	flaky = &flakyFeedStore{Failures: 5, Err: &CloudantError{Err: &NonRetryableError{Err: errors.New("unauthorized")}}}
+	if _, err := (&RetryFeedStore{Store: flaky, MaxRetries: 3}).GetFeeds(ctx); err == nil || flaky.calls != 1 {
+		t.Errorf("GetFeeds = %v after %d calls, want an error after 1", err, flaky.calls)
+	}
+}
+
+func TestRunEmitsSummary(t *testing.T) {
+	db, _ := setupRun(t, testFeeds("A", "B"), map[string]int{"A": 2, "B": 0})
+	t.Setenv("emit_summary", "true")
+	t.Setenv("ingest_date", "2024-03-05")
+	var runErr error
+	output := captureStdout(t, func() { runErr = runAgainst(db) })
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	summary := summaryLine(t, output)
+	if summary.IngestDate != "2024-3-5" || summary.IngestStart != "2024-03-05T00:00:00Z" || summary.IngestEnd != "2024-03-06T00:00:00Z" {
+		t.Errorf("ingest window = %s %s-%s", summary.IngestDate, summary.IngestStart, summary.IngestEnd)
+	}
+	if summary.TotalFeeds != 2 || summary.TotalArticles != 2 || summary.ZeroIngestion != 1 || summary.ZeroPercent != 50 || summary.Error != "" {
+		t.Errorf("summary = %+v", summary)
+	}
+	if summary.RunID != runID || summary.EndTime.Before(summary.StartTime) {
+		t.Errorf("summary = %+v, want this run's ID and times", summary)
+	}
+
+	t.Setenv("report_timezone", "America/New_York")
+	output = captureStdout(t, func() { runErr = runAgainst(db) })
+	if summary := summaryLine(t, output); summary.IngestStart != "2024-03-05T00:00:00-05:00" {
+		t.Errorf("ingest_start = %s, want midnight in New York", summary.IngestStart)
+	}
+
+	t.Setenv("report_sort", "bogus")
+	output = captureStdout(t, func() { runErr = runAgainst(db) })
+	if runErr == nil {
+		t.Fatal("run with a bad report_sort succeeded")
+	}
+	if summary := summaryLine(t, output); !strings.Contains(summary.Error, "report_sort") {
+		t.Errorf("summary error = %q, want the run's error", summary.Error)
+	}
+}
+
+func TestDedupeFeeds(t *testing.T) {
+	feeds := []Feed{
+		{Publisher: "Pub", FeedName: "A", FeedUrl: "https://a.example"},
+		{Publisher: "Pub", FeedName: "A", FeedUrl: "https://a2.example"},
+		{Publisher: "Pub", FeedName: "A2", FeedUrl: "https://a.example"},
+		{Publisher: "Other", FeedName: "A", FeedUrl: "https://other.example"},
+		{Publisher: "Pub", FeedName: "B"},
+		{Publisher: "Pub", FeedName: "C"},
+	}
+	deduped, dropped := DedupeFeeds(feeds)
+	if dropped != 2 || len(deduped) != 4 {
+		t.Fatalf("dropped %d, kept %+v", dropped, deduped)
+	}
+	if deduped[1].Publisher != "Other" {
+		t.Errorf("deduped = %+v, want Other's A kept", deduped)
+	}
+}
+
+func TestRunQueriesEachFeedOnce(t *testing.T) {
+	feeds := append(testFeeds("A", "B"), testFeeds("A")...)
+	db, _ := setupRun(t, feeds, map[string]int{"A": 1, "B": 1})
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if queries := db.queries(); len(queries) != 2 {
+		t.Errorf("made %d DB queries, want 2: %v", len(queries), queries)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var body map[string]string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	notifier := &SlackNotifier{WebhookURL: srv.URL, Client: srv.Client()}
+	err := notifier.Notify(context.Background(), Notification{RunDate: "2024-3-5", TotalArticles: 10, ZeroIngestionMagazines: []string{"Quiet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"*RSS Feed Health Status 2024-3-5*", "Total articles ingested: 10", "(1):\n• Quiet"} {
+		if !strings.Contains(body["text"], want) {
+			t.Errorf("text = %q, want it to contain %q", body["text"], want)
+		}
+	}
+	status = http.StatusForbidden
+	if err := notifier.Notify(context.Background(), Notification{}); err == nil {
+		t.Error("Notify succeeded on a 403")
+	}
+}
+
+func TestRunSendOnChangeOnly(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	t.Setenv("send_on_change_only", "true")
+	for i := 0; i < 2; i++ {
+		if err := runAgainst(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(brevo.sent()); n != 1 {
+		t.Errorf("sent %d reports for unchanged data, want 1", n)
+	}
+	db.Counts["A"] = 2
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(brevo.sent()); n != 2 {
+		t.Errorf("sent %d reports, want 2 once the data changed", n)
+	}
+}
+
+func TestRunSendOnChangeOnlyAfterDryRun(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	t.Setenv("send_on_change_only", "true")
+	t.Setenv("dry_run", "true")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("dry_run", "")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(brevo.sent()); n != 1 {
+		t.Errorf("sent %d reports, want the first real run to send despite the dry run", n)
+	}
+}
+
+func TestLastRunData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last.json")
+	if data, err := LoadLastRunData(path); data != nil || err != nil {
+		t.Errorf("LoadLastRunData of a missing file = %v, %v, want nil, nil", data, err)
+	}
+	want := map[string]int{"A": 1, "B": 0}
+	if err := SaveLastRunData(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadLastRunData(path)
+	if err != nil || !MagDataEqual(got, want) {
+		t.Errorf("LoadLastRunData = %v, %v, want %v", got, err, want)
+	}
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := LoadLastRunData(path); err == nil {
+		t.Error("LoadLastRunData of invalid JSON succeeded")
+	}
+}
+
+func TestMagDataEqual(t *testing.T) {
+	tests := []struct {
+		a, b map[string]int
+		want bool
+	}{
+		{nil, map[string]int{}, true},
+		{map[string]int{"A": 1}, map[string]int{"A": 1}, true},
+		{map[string]int{"A": 1}, map[string]int{"A": 2}, false},
+		{map[string]int{"A": 0}, map[string]int{"B": 0}, false},
+		{map[string]int{"A": 1}, map[string]int{"A": 1, "B": 1}, false},
+	}
+	for _, tt := range tests {
+		if got := MagDataEqual(tt.a, tt.b); got != tt.want {
+			t.Errorf("MagDataEqual(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestBuildCSVBOMAndDelimiter(t *testing.T) {
+	var buf bytes.Buffer
+	if err := BuildCSV(&buf, Report{MagData: map[string]int{"A": 1}, Keys: []string{"A"}, BOM: true, Delimiter: ';'}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("\xEF\xBB\xBFmagazine;articles\n")) {
+		t.Errorf("csv = %q, want a BOM and ; delimiter", buf.String())
+	}
+}
+
+func TestBuildXLSX(t *testing.T) {
+	b, err := buildXLSX(map[string]int{"A & B": 0, "C": 7}, []string{"A & B", "C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet string
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			sheet = string(content)
+		}
+	}
+	for _, want := range []string{
+		`<t>A &amp; B</t></is></c><c r="B2"><v>0</v>`,
+		`<c r="B3"><v>7</v>`,
+		`state="frozen"`,
+		`sqref="A2:B3"`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet1.xml = %q, want it to contain %q", sheet, want)
+		}
+	}
+	if len(zr.File) != 6 {
+		t.Errorf("xlsx has %d parts, want 6", len(zr.File))
+	}
+}
+
+func TestSendBrevoEmail(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	err := SendBrevoEmail(context.Background(), httpClient, BrevoQuery{
+		Sender:  NewBrevoSender(),
+		To:      []BrevoTo{{Email: "a@example.com"}, {Email: "A@Example.com"}, {Email: "not an address"}},
+		Cc:      []BrevoTo{{Email: "a@example.com"}, {Email: "c@example.com"}},
+		Bcc:     []BrevoTo{{Email: "c@example.com"}, {Email: "d@example.com"}, {Email: "Dee <d2@example.com>"}},
+		Subject: "Report",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if want := []BrevoTo{{Email: "a@example.com"}}; !reflect.DeepEqual(email.To, want) {
+		t.Errorf("To = %v, want %v", email.To, want)
+	}
+	if want := []BrevoTo{{Email: "c@example.com"}}; !reflect.DeepEqual(email.Cc, want) {
+		t.Errorf("Cc = %v, want %v", email.Cc, want)
+	}
+	if want := []BrevoTo{{Email: "d@example.com"}}; !reflect.DeepEqual(email.Bcc, want) {
+		t.Errorf("Bcc = %v, want %v", email.Bcc, want)
+	}
+
+	header := brevo.headers[0]
+	for key, want := range map[string]string{
+		"api-key":      "test-key",
+		"Content-Type": "application/json",
+		"Accept":       "application/json",
+		"User-Agent":   "health-checker/" + version,
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDedupeRecipientsKeepsOrder(t *testing.T) {
+	got := dedupeRecipients([]BrevoTo{{Email: "b@example.com"}, {Email: "a@example.com"}, {Email: " B@example.com"}})
+	if want := []BrevoTo{{Email: "b@example.com"}, {Email: "a@example.com"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupeRecipients = %v, want %v", got, want)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := SplitList(" a, ,b ,,c "); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("SplitList = %q", got)
+	}
+	if got := SplitList(""); got != nil {
+		t.Errorf("SplitList(\"\") = %q", got)
+	}
+}
+
+func TestBuildDetailCSV(t *testing.T) {
+	b, err := BuildDetailCSV(map[string][]DBRow{
+		"A": {{ArticleTitle: "Hello, world", ArticlePublisher: "Pub", ArticleUrl: "https://a.example/1", ArticlePubdate: 1709640000}},
+	}, []string{"B", "A"}, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "magazine;article_title;article_publisher;article_url;article_pubdate\nA;Hello, world;Pub;https://a.example/1;2024-03-05 12:00 UTC\n"
+	if string(b) != want {
+		t.Errorf("BuildDetailCSV = %q, want %q", b, want)
+	}
+}
+
+func TestFormatPubdate(t *testing.T) {
+	tests := []struct {
+		epoch int64
+		want  string
+	}{
+		{0, "unknown"},
+		{-5, "unknown"},
+		{1709640000, "2024-03-05 12:00 UTC"},
+		{1709640000000, "2024-03-05 12:00 UTC"},
+	}
+	for _, tt := range tests {
+		if got := formatPubdate(tt.epoch); got != tt.want {
+			t.Errorf("formatPubdate(%d) = %q, want %q", tt.epoch, got, tt.want)
+		}
+	}
+}
+
+func TestCloudantHistoryStore(t *testing.T) {
+	cloudant := newFakeCloudant(t)
+	store := &CloudantHistoryStore{Service: cloudant.service(t), DbName: "history"}
+	ctx := context.Background()
+
+	for _, articles := range []int{1, 2} {
+		err := store.SaveHistory(ctx, HistoryDoc{
+			RunDate:     "2024-3-6",
+			IngestDate:  "2024-03-05",
+			IngestStart: "2024-03-05T00:00:00Z",
+			IngestEnd:   "2024-03-06T00:00:00Z",
+			MagData:     map[string]int{"A": articles},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if doc := cloudant.doc("history", "history-2024-03-05"); doc["mag_data"].(map[string]interface{})["A"] != 2.0 {
+		t.Errorf("doc = %v, want the rerun's counts", doc)
+	}
+	docs, err := store.LoadHistory(ctx, []string{"2024-03-05", "2024-03-04"})
+	if err != nil || len(docs) != 1 || docs[0].MagData["A"] != 2 {
+		t.Fatalf("LoadHistory = %+v, %v", docs, err)
+	}
+	if docs[0].IngestStart != "2024-03-05T00:00:00Z" || docs[0].IngestEnd != "2024-03-06T00:00:00Z" {
+		t.Errorf("ingest window = %s-%s, want the saved window", docs[0].IngestStart, docs[0].IngestEnd)
+	}
+
+	streaks, err := store.LoadStreaks(ctx)
+	if err != nil || len(streaks) != 0 {
+		t.Errorf("LoadStreaks with no document = %v, %v", streaks, err)
+	}
+	want := map[string]FeedStreak{"A": {FailureStreak: 2, LastSuccess: "2024-03-01T00:00:00Z"}}
+	for i := 0; i < 2; i++ {
+		if err := store.SaveStreaks(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := (&CloudantHistoryStore{Service: store.Service, DbName: "history"}).LoadStreaks(ctx)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadStreaks = %v, %v, want %v", got, err, want)
+	}
+
+	cloudant.SetStatus(http.StatusInternalServerError)
+	var cloudantErr *CloudantError
+	if err := store.SaveHistory(ctx, HistoryDoc{IngestDate: "2024-03-06"}); !errors.As(err, &cloudantErr) {
+		t.Errorf("SaveHistory = %v, want a CloudantError", err)
+	}
+}
+
+func TestRunSavesIngestWindow(t *testing.T) {
+	db, _ := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	cloudant := newFakeCloudant(t)
+	t.Setenv("persist_history", "true")
+	t.Setenv("ingest_date", "2024-03-05")
+	t.Setenv("db_use_range", "true")
+	t.Setenv("ingest_window", "36h")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	doc := cloudant.doc("health_check_history", "history-2024-03-05")
+	if doc["ingest_start"] != "2024-03-05T00:00:00Z" || doc["ingest_end"] != "2024-03-06T12:00:00Z" {
+		t.Errorf("history doc = %v, want the 36h ingest window", doc)
+	}
+}
+
+func TestBuildWeeklyTrend(t *testing.T) {
+	store := &memHistoryStore{docs: map[string]HistoryDoc{
+		"2024-03-09": {IngestDate: "2024-03-09", MagData: map[string]int{"A": 3}},
+		"2024-03-04": {IngestDate: "2024-03-04", MagData: map[string]int{"B": 1}},
+	}}
+	ingestDate := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	b, err := BuildWeeklyTrend(context.Background(), store, ingestDate, map[string]int{"A": 5}, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"magazine", "2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07", "2024-03-08", "2024-03-09", "2024-03-10"},
+		{"A", "", "", "", "", "", "3", "5"},
+		{"B", "1", "", "", "", "", "", ""},
+	}
+	if rows := csvRows(t, b); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+	if len(store.loaded) != 6 || store.loaded[5] != "2024-03-09" {
+		t.Errorf("loaded history for %v, want the 6 days before", store.loaded)
+	}
+}
+
+func TestBuildTrendPivot(t *testing.T) {
+	rows := BuildTrendPivot([]map[string]int{nil, {"b": 1, "a": 0}}, []string{"d1", "d2"})
+	want := [][]string{{"magazine", "d1", "d2"}, {"a", "", "0"}, {"b", "", "1"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("BuildTrendPivot = %v, want %v", rows, want)
+	}
+}
+
+func TestFindBelowExpected(t *testing.T) {
+	allMagData := map[string]int{"A": 3, "B": 0, "C": 2}
+	below := FindBelowExpected(allMagData, []string{"A", "B", "C"}, map[string]int{"A": 5}, 1)
+	want := []BelowExpected{{Magazine: "A", Articles: 3, MinArticles: 5}, {Magazine: "B", Articles: 0, MinArticles: 1}}
+	if !reflect.DeepEqual(below, want) {
+		t.Errorf("FindBelowExpected = %+v, want %+v", below, want)
+	}
+	if below := FindBelowExpected(allMagData, []string{"A", "B", "C"}, nil, 0); below != nil {
+		t.Errorf("FindBelowExpected with no minimums = %+v", below)
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	var raw []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	notifier := &TeamsNotifier{WebhookURL: srv.URL, Client: srv.Client()}
+	err := notifier.Notify(context.Background(), Notification{RunDate: "2024-3-5", ZeroIngestionMagazines: []string{"Quiet"}, FailedMagazines: []string{"Down"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var card struct {
+		Type        string
+		Attachments []struct {
+			ContentType string
+			Content     struct {
+				Type string
+				Body []struct{ Text string }
+			}
+		}
+	}
+	if err := json.Unmarshal(raw, &card); err != nil {
+		t.Fatal(err)
+	}
+	if card.Type != "message" || card.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" || card.Attachments[0].Content.Type != "AdaptiveCard" {
+		t.Fatalf("card = %s", raw)
+	}
+	var texts []string
+	for _, block := range card.Attachments[0].Content.Body {
+		texts = append(texts, block.Text)
+	}
+	joined := strings.Join(texts, "\n")
+	for _, want := range []string{"- Quiet", "Magazines whose DB lookups failed (1):", "- Down"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("card text = %q, want it to contain %q", joined, want)
+		}
+	}
+}
+
+func TestSkipFeeds(t *testing.T) {
+	feeds := []Feed{
+		{Publisher: "Pub", FeedName: "Keep"},
+		{Publisher: "Pub", FeedName: " Skip Me "},
+		{Publisher: "Noisy Inc", FeedName: "Other"},
+	}
+	kept, skipped := SkipFeeds(feeds, []string{"skip me"}, []string{"NOISY INC"})
+	if skipped != 2 || len(kept) != 1 || kept[0].FeedName != "Keep" {
+		t.Errorf("SkipFeeds = %+v, %d", kept, skipped)
+	}
+	if kept, skipped := SkipFeeds(feeds, nil, nil); skipped != 0 || len(kept) != 3 {
+		t.Errorf("SkipFeeds with no lists = %+v, %d", kept, skipped)
+	}
+}
+
+func TestCompressAttachment(t *testing.T) {
+	content := bytes.Repeat([]byte("magazine,articles\n"), 100)
+	if b, name, err := CompressAttachment(content, "r.csv", 0); err != nil || name != "r.csv" || !bytes.Equal(b, content) {
+		t.Errorf("threshold 0 = %q, %v", name, err)
+	}
+	if _, name, _ := CompressAttachment(content, "r.csv", len(content)); name != "r.csv" {
+		t.Errorf("at the threshold = %q, want it uncompressed", name)
+	}
+	b, name, err := CompressAttachment(content, "r.csv", 100)
+	if err != nil || name != "r.csv.gz" {
+		t.Fatalf("over the threshold = %q, %v", name, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); !bytes.Equal(got, content) {
+		t.Error("gzipped content doesn't round trip")
+	}
+}
+
+func TestFeedSelector(t *testing.T) {
+	selector, err := FeedSelector("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"$exists": true}; !reflect.DeepEqual(selector["Publisher_Name"], want) {
+		t.Errorf("Publisher_Name = %v, want %v", selector["Publisher_Name"], want)
+	}
+
+	selector, _ = FeedSelector("Acme", "")
+	if want := map[string]interface{}{"$eq": "Acme"}; !reflect.DeepEqual(selector["Publisher_Name"], want) {
+		t.Errorf("Publisher_Name = %v, want %v", selector["Publisher_Name"], want)
+	}
+
+	selector, err = FeedSelector("Acme", `{"type": "publisher"}`)
+	if err != nil || !reflect.DeepEqual(selector, map[string]interface{}{"type": "publisher"}) {
+		t.Errorf("selector = %v, %v, want the JSON override", selector, err)
+	}
+	for _, bad := range []string{`{"type":`, `{}`} {
+		if _, err := FeedSelector("", bad); err == nil {
+			t.Errorf("FeedSelector(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCloudantFeedStore(t *testing.T) {
+	cloudant := newFakeCloudant(t)
+	for i := 0; i < 5; i++ {
+		cloudant.Feeds = append(cloudant.Feeds, map[string]interface{}{
+			"_id":            fmt.Sprintf("pub%d", i),
+			"Publisher_Name": fmt.Sprintf("Pub %d", i),
+			"RSS_Feeds":      []map[string]string{{"RSS_Feed_Name": fmt.Sprintf("Mag %d", i)}},
+		})
+	}
+	cloudant.Feeds[3]["Publisher_Name"] = 3
+
+	store := &CloudantFeedStore{Service: cloudant.service(t), DbName: "publishers", PageLimit: 2}
+	feeds, err := store.GetFeeds(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 4 {
+		t.Errorf("got %d feeds, want 4", len(feeds))
+	}
+	if malformed := store.MalformedDocs(); len(malformed) != 1 || malformed[0].DocID != "pub3" {
+		t.Errorf("MalformedDocs = %+v, want pub3", malformed)
+	}
+	finds := cloudant.findRequests()
+	if len(finds) != 3 {
+		t.Fatalf("made %d _find requests, want 3", len(finds))
+	}
+	if finds[0]["limit"] != 2.0 || finds[0]["bookmark"] != nil || finds[2]["bookmark"] != "4" {
+		t.Errorf("_find requests = %v, want pages of 2 following the bookmark", finds)
+	}
+	selector := finds[0]["selector"].(map[string]interface{})
+	if _, ok := selector["RSS_Feeds"]; !ok {
+		t.Errorf("selector = %v, want the default", selector)
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		base, path, want string
+	}{
+		{"http://db.example/", "/v2/articles", "http://db.example/v2/articles"},
+		{"http://db.example", "v2/articles", "http://db.example/v2/articles"},
+		{"http://db.example//", "//v2/articles", "http://db.example/v2/articles"},
+		{"http://db.example/api/", "v2/articles", "http://db.example/api/v2/articles"},
+		{"http://db.example/", "", "http://db.example/"},
+	}
+	for _, tt := range tests {
+		if got := joinURL(tt.base, tt.path); got != tt.want {
+			t.Errorf("joinURL(%q, %q) = %q, want %q", tt.base, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestZeroIngestionPercent(t *testing.T) {
+	if got := ZeroIngestionPercent(nil); got != 0 {
+		t.Errorf("ZeroIngestionPercent(nil) = %v", got)
+	}
+	if got := ZeroIngestionPercent(map[string]int{"A": 0, "B": 1, "C": 2, "D": 0}); got != 50 {
+		t.Errorf("ZeroIngestionPercent = %v, want 50", got)
+	}
+}
+
+func TestLoadReportLocation(t *testing.T) {
+	if loc := LoadReportLocation(""); loc != time.UTC {
+		t.Errorf("LoadReportLocation(\"\") = %v", loc)
+	}
+	if loc := LoadReportLocation("Europe/Paris"); loc.String() != "Europe/Paris" {
+		t.Errorf("LoadReportLocation = %v", loc)
+	}
+	if loc := LoadReportLocation("Mars/Olympus_Mons"); loc != time.UTC {
+		t.Errorf("LoadReportLocation of an unknown zone = %v, want UTC", loc)
+	}
+}
+
+func TestDefaultIngestDate(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 5, 3, 30, 0, 0, time.UTC)
+	tests := []struct {
+		loc  *time.Location
+		want string
+	}{
+		{time.UTC, "2024-3-4"},
+		{ny, "2024-3-3"}, // still the evening of the 4th in New York
+	}
+	for _, tt := range tests {
+		if got := DefaultIngestDate(now, tt.loc).Format("2006-1-2"); got != tt.want {
+			t.Errorf("DefaultIngestDate(%s, %s) = %s, want %s", now, tt.loc, got, tt.want)
+		}
+	}
+}
+
+func TestRunRecoversFromPanic(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("Good", "Bad"), map[string]int{"Good": 1})
+	client := httpClient
+	httpClient = &http.Client{Transport: panicTransport{Magazine: "Bad"}}
+	t.Cleanup(func() { httpClient = client })
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if !strings.Contains(email.HtmlContent, "Feeds failed: 1 (Bad)") {
+		t.Errorf("body = %q, want Bad failed", email.HtmlContent)
+	}
+	if rows := attachmentRows(t, email.Attachment[0]); findRow(rows, "Good") == nil {
+		t.Errorf("rows = %v, want Good reported", rows)
+	}
+}
+
+func TestTriageReport(t *testing.T) {
+	subject, body := TriageReport("Report", "<html><body>hi</body></html>", true)
+	if subject != "All feeds healthy: Report" || body != "<html><body><p><b>All feeds healthy</b></p>hi</body></html>" {
+		t.Errorf("healthy = %q, %q", subject, body)
+	}
+	subject, body = TriageReport("Report", "<html><body>hi</body></html>", false)
+	if subject != "⚠️ Action needed: Report" || body != "<html><body>hi</body></html>" {
+		t.Errorf("unhealthy = %q, %q", subject, body)
+	}
+}
+
+func TestReportDataHealthy(t *testing.T) {
+	tests := []struct {
+		data ReportData
+		want bool
+	}{
+		{ReportData{}, true},
+		{ReportData{ZeroIngestion: 1}, false},
+		{ReportData{ZeroIngestion: 1, ZeroInGrace: 1}, true},
+		{ReportData{ZeroIngestion: 2, ZeroSuppressed: true}, true},
+		{ReportData{FailedFeeds: 1, ZeroSuppressed: true}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.data.Healthy(); got != tt.want {
+			t.Errorf("%+v Healthy() = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	db, _ := setupRun(t, testFeeds("A", "B"), map[string]int{"A": 3})
+	db.Broken = map[string]bool{"B": true}
+	m := metrics
+	metrics = NewMetrics()
+	t.Cleanup(func() { metrics = m })
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	for _, want := range []string{
+		"health_checker_feeds_processed_total 2\n",
+		"health_checker_failed_feeds_total 1\n",
+		"health_checker_emails_sent_total 1\n",
+		"# TYPE health_checker_articles_ingested gauge\n",
+		`health_checker_articles_ingested{magazine="A"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics = %q, want %q", buf.String(), want)
+		}
+	}
+}
+
+func TestMetricsPush(t *testing.T) {
+	var path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		path, body = r.Method+" "+r.URL.Path, string(b)
+	}))
+	defer srv.Close()
+	m := NewMetrics()
+	m.Add("runs_total", 1)
+	if err := m.Push(context.Background(), srv.Client(), srv.URL+"/", "health_checker"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "PUT /metrics/job/health_checker" || !strings.Contains(body, "runs_total 1") {
+		t.Errorf("pushed %s: %q", path, body)
+	}
+}
+
+func TestCron(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC), time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+		{"30 8 * * 7", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 7, 8, 30, 0, 0, time.UTC)},
+		{"0 0 15 * 1", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 2 *", time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2024, 1, 1, 7, 0, 0, 0, ny), time.Date(2024, 1, 2, 6, 0, 0, 0, ny)},
+	}
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) = %v", tt.expr, err)
+			continue
+		}
+		if got, ok := cron.Next(tt.from); !ok || !got.Equal(tt.want) {
+			t.Errorf("%q Next(%s) = %s, %v, want %s", tt.expr, tt.from, got, ok, tt.want)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * 0 * *", "0 0 30 2 *", "0 0 31 4,6 *"} {
+		if _, err := ParseCron(bad); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	cron, err := ParseCron("0 6 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{ctx: ctx, now: time.Date(2024, 1, 1, 5, 30, 0, 0, time.UTC)}
+	var runs []time.Time
+	RunScheduled(ctx, cron, clock, func(ctx context.Context) error {
+		runs = append(runs, clock.Now())
+		switch len(runs) {
+		case 1:
+			return errors.New("a failed run doesn't stop the schedule")
+		case 3:
+			cancel()
+		}
+		return nil
+	})
+	want := []time.Time{
+		time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 3, 6, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("runs = %v, want %v", runs, want)
+	}
+}
+
+func TestRealClockUsesLocation(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc := (realClock{Loc: ny}).Now().Location(); loc != ny {
+		t.Errorf("Now() is in %s, want America/New_York", loc)
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	feeds := testFeeds("Mag A", "Mag B")
+	feeds[1].Publisher = "Other"
+	db, brevo := setupRun(t, feeds, map[string]int{"Mag A": 1500, "Mag B": 2})
+	outputPath := filepath.Join(t.TempDir(), "reports", "today.csv")
+	t.Setenv("output_csv_path", outputPath)
+	t.Setenv("attachment_name_template", "{{.ProgramName}}/report:{{.TotalArticles}}")
+	t.Setenv("program_name", "Gaming")
+	t.Setenv("sender_email", "gaming@example.com")
+	t.Setenv("report_cc", "cc@example.com, ops@example.com")
+	t.Setenv("report_bcc", "bcc@example.com")
+	t.Setenv("report_sort", "name")
+	t.Setenv("db_article_path", "/custom/articles")
+	t.Setenv("group_by_publisher", "true")
+	t.Setenv("report_body_template", "<html><body>{{range .Magazines}}[{{.Name}}={{thousands .Articles}}]{{end}}</body></html>")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+
+	email := brevo.lastEmail(t)
+	if want := (BrevoSender{Name: "Gaming Mailer", Email: "gaming@example.com"}); email.Sender != want {
+		t.Errorf("sender = %+v, want %+v", email.Sender, want)
+	}
+	if !strings.HasPrefix(email.Subject, "Gaming Feed Health Status — 1,502 articles") {
+		t.Errorf("subject = %q", email.Subject)
+	}
+	if want := "Gaming_report_1502.csv"; email.Attachment[0].Name != want {
+		t.Errorf("attachment name = %q, want %q", email.Attachment[0].Name, want)
+	}
+	if want := []BrevoTo{{Email: "cc@example.com"}}; !reflect.DeepEqual(email.Cc, want) {
+		t.Errorf("Cc = %v, want %v", email.Cc, want)
+	}
+	if want := []BrevoTo{{Email: "bcc@example.com"}}; !reflect.DeepEqual(email.Bcc, want) {
+		t.Errorf("Bcc = %v, want %v", email.Bcc, want)
+	}
+	for _, want := range []string{"[Mag A=1,500][Mag B=2]", "<td>Other</td>", "<td>Pub</td>"} {
+		if !strings.Contains(email.HtmlContent, want) {
+			t.Errorf("body = %q, want it to contain %q", email.HtmlContent, want)
+		}
+	}
+	if db.paths[0] != "/custom/articles" {
+		t.Errorf("path = %q, want /custom/articles", db.paths[0])
+	}
+
+	onDisk, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, _ := base64.StdEncoding.DecodeString(email.Attachment[0].Content)
+	if !bytes.Equal(onDisk, attached) {
+		t.Errorf("output_csv_path = %q, want the attached CSV %q", onDisk, attached)
+	}
+	if rows := csvRows(t, onDisk); !reflect.DeepEqual(rows[0], []string{"publisher", "magazine", "articles"}) {
+		t.Errorf("header = %v, want the publisher column", rows[0])
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := map[string]string{
+		`a/b\c:d`:     "a_b_c_d",
+		" ..x.. ":     "x",
+		"a\tb\x7f":    "ab",
+		"":            "daily_article_data",
+		"..":          "daily_article_data",
+		"report 2024": "report 2024",
+	}
+	for in, want := range tests {
+		if got := SanitizeFileName(in); got != want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRunMultipleDBs(t *testing.T) {
+	feeds := testFeeds("A")
+	db1, brevo := setupRun(t, feeds, map[string]int{"A": 2})
+	db2 := newFakeDB(t, map[string]int{"A": 3})
+	config := &Config{DBURLs: []string{db1.BaseURL(), db2.BaseURL()}}
+
+	for mode, want := range map[string]string{"sum": "5", "max": "3"} {
+		t.Setenv("db_combine_mode", mode)
+		if err := run(context.Background(), config); err != nil {
+			t.Fatal(err)
+		}
+		rows := attachmentRows(t, brevo.lastEmail(t).Attachment[0])
+		if got := findRow(rows, "A"); got[1] != want {
+			t.Errorf("%s: A = %v, want %s", mode, got, want)
+		}
+	}
+}
+
+func TestCombineDBResults(t *testing.T) {
+	rows := [][]DBRow{{{Id: 1}}, {{Id: 2}, {Id: 3}}}
+	if got := CombineDBRows(rows, "sum"); len(got) != 3 {
+		t.Errorf("CombineDBRows sum = %v", got)
+	}
+	if got := CombineDBRows(rows, "max"); len(got) != 2 || got[0].Id != 2 {
+		t.Errorf("CombineDBRows max = %v", got)
+	}
+	if got := CombineCounts([]int{2, 5, 3}, "sum"); got != 10 {
+		t.Errorf("CombineCounts sum = %d", got)
+	}
+	if got := CombineCounts([]int{2, 5, 3}, "max"); got != 5 {
+		t.Errorf("CombineCounts max = %d", got)
+	}
+	tests := []struct {
+		counts    []int
+		threshold int
+		want      bool
+	}{
+		{[]int{5}, 0, false},
+		{[]int{5, 5}, 0, false},
+		{[]int{5, 7}, 1, true},
+		{[]int{5, 7}, 2, false},
+	}
+	for _, tt := range tests {
+		if got := DBDiscrepancy(tt.counts, tt.threshold); got != tt.want {
+			t.Errorf("DBDiscrepancy(%v, %d) = %v, want %v", tt.counts, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestRunWithDBFixture(t *testing.T) {
+	for _, countMode := range []string{"rows", "field"} {
+		t.Run(countMode, func(t *testing.T) {
+			brevo := newFakeBrevo(t)
+			t.Setenv("feeds_file", writeJSONFile(t, "feeds.json", testFeeds("A", "B")))
+			t.Setenv("db_fixture_json", writeJSONFile(t, "fixture.json", map[string]int{"A": 3, "B": 0}))
+			t.Setenv("db_count_mode", countMode)
+			t.Setenv("email_address", "ops@example.com")
+			if err := run(context.Background(), &Config{}); err != nil {
+				t.Fatal(err)
+			}
+			rows := attachmentRows(t, brevo.lastEmail(t).Attachment[0])
+			if got := findRow(rows, "A"); !reflect.DeepEqual(got, []string{"A", "3"}) {
+				t.Errorf("A = %v, want 3 articles", got)
+			}
+			if got := findRow(rows, "TOTAL"); !reflect.DeepEqual(got, []string{"TOTAL", "3"}) {
+				t.Errorf("TOTAL = %v, want 3", got)
+			}
+		})
+	}
+}
+
+func TestFixtureTransport(t *testing.T) {
+	fixture, err := LoadDBFixture(writeJSONFile(t, "fixture.json", map[string]int{"A": 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: fixture}
+	rows, count, _, err := FetchArticles(context.Background(), client, nil, "rows", 0, "http://fixture/?magazine=A")
+	if err != nil || count != 2 || rows[1].ArticleMagazine != "A" {
+		t.Errorf("FetchArticles = %v, %d, %v", rows, count, err)
+	}
+	batchRows, counts, _, err := FetchArticleBatch(context.Background(), client, nil, "rows", 0, "http://fixture/?magazines=A,B")
+	if err != nil || counts["A"] != 2 || counts["B"] != 0 || len(batchRows) != 2 {
+		t.Errorf("FetchArticleBatch = %v, %v", counts, err)
+	}
+	if _, err := LoadDBFixture(writeJSONFile(t, "bad.json", []int{1})); err == nil {
+		t.Error("LoadDBFixture of a list succeeded")
+	}
+}
+
+func TestNormalizeFeeds(t *testing.T) {
+	feeds := []Feed{{FeedName: "  Mag   One "}, {FeedName: "Mag Two"}}
+	got, err := NormalizeFeeds(feeds, "")
+	if err != nil || got[0].FeedName != "Mag One" || got[0].DisplayName != "" {
+		t.Errorf("NormalizeFeeds = %+v, %v", got, err)
+	}
+
+	feeds = []Feed{{FeedName: " Mag   One"}, {FeedName: "mag two"}}
+	got, err = NormalizeFeeds(feeds, "lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].FeedName != "mag one" || got[0].Name() != "Mag One" {
+		t.Errorf("feed = %+v, want mag one shown as Mag One", got[0])
+	}
+	if got[1].FeedName != "mag two" || got[1].DisplayName != "" {
+		t.Errorf("feed = %+v, want it unchanged", got[1])
+	}
+	if got := NormalizeFeedName(" a  b ", "upper"); got != "A B" {
+		t.Errorf("NormalizeFeedName = %q, want A B", got)
+	}
+	if _, err := NormalizeFeeds(feeds, "title"); err == nil {
+		t.Error("NormalizeFeeds with an unknown case succeeded")
+	}
+}
+
+func TestNewBrevoSender(t *testing.T) {
+	if sender := NewBrevoSender(); sender != (BrevoSender{Name: "RSS Mailer", Email: "WM.RSS.mailer@gmail.com"}) {
+		t.Errorf("default sender = %+v", sender)
+	}
+	t.Setenv("program_name", "Podcasts")
+	t.Setenv("sender_email", "podcasts@example.com")
+	if sender := NewBrevoSender(); sender != (BrevoSender{Name: "Podcasts Mailer", Email: "podcasts@example.com"}) {
+		t.Errorf("sender = %+v", sender)
+	}
+}
+
+func TestMagazineLink(t *testing.T) {
+	link, err := MagazineLink("", "A & B")
+	if err != nil || link != "A &amp; B" {
+		t.Errorf("MagazineLink without a template = %q, %v", link, err)
+	}
+	link, err = MagazineLink("https://dash.example/m?name={{.Magazine}}", "A & B")
+	if want := `<a href="https://dash.example/m?name=A+%26+B">A &amp; B</a>`; err != nil || link != want {
+		t.Errorf("MagazineLink = %q, %v, want %q", link, err, want)
+	}
+	link, err = MagazineLink("https://dash.example/m/{{.MagazinePath}}", "A & B/C")
+	if want := `<a href="https://dash.example/m/A%20&amp;%20B%2FC">A &amp; B/C</a>`; err != nil || link != want {
+		t.Errorf("MagazineLink with a path = %q, %v, want %q", link, err, want)
+	}
+	if _, err := MagazineLink("{{.Nope}}", "A"); err == nil {
+		t.Error("MagazineLink with a bad template succeeded")
+	}
+}
+
+func TestRunLinksMagazinesInDefaultBody(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("Mag A"), map[string]int{"Mag A": 1200})
+	t.Setenv("dashboard_url_template", "https://dash.example/m/{{.MagazinePath}}")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	body := brevo.lastEmail(t).HtmlContent
+	if want := `<tr><td><a href="https://dash.example/m/Mag%20A">Mag A</a></td><td>1,200</td></tr>`; !strings.Contains(body, want) {
+		t.Errorf("body = %q, want it to contain %q", body, want)
+	}
+}
+
+func TestHTTPClientReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := NewHTTPClient()
+	for i := 0; i < 5; i++ {
+		if _, _, _, err := FetchArticles(context.Background(), client, nil, "rows", i, srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("opened %d connections for 5 requests, want 1 kept alive", conns)
+	}
+}
+
+func TestNewHTTPClientUsesProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, "[]")
+	}))
+	defer proxy.Close()
+	t.Setenv("proxy_url", proxy.URL)
+
+	if err := CheckDB(context.Background(), NewHTTPClient(), "http://db.invalid/articles"); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxied) != 1 || !strings.HasPrefix(proxied[0], "http://db.invalid/articles?") {
+		t.Errorf("proxy saw %v, want the DB request", proxied)
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	t.Setenv("proxy_url", "http://proxy.example:3128")
+	t.Setenv("http_max_idle_conns", "7")
+	t.Setenv("http_max_idle_conns_per_host", "3")
+	t.Setenv("http_max_conns_per_host", "5")
+	transport := NewHTTPClient().Transport.(*http.Transport)
+	req, _ := http.NewRequest("GET", "https://db.example/", nil)
+	proxy, err := transport.Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example:3128" {
+		t.Errorf("proxy = %v, %v, want proxy.example:3128", proxy, err)
+	}
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 3 || transport.MaxConnsPerHost != 5 {
+		t.Errorf("limits = %d/%d/%d, want 7/3/5", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+
+	t.Setenv("proxy_url", "not a url")
+	t.Setenv("http_max_idle_conns", "-1")
+	t.Setenv("http_max_idle_conns_per_host", "")
+	t.Setenv("http_max_conns_per_host", "lots")
+	t.Setenv("HTTPS_PROXY", "")
+	transport = NewHTTPClient().Transport.(*http.Transport)
+	if proxy, _ := transport.Proxy(req); proxy != nil {
+		t.Errorf("proxy = %v, want none from the environment", proxy)
+	}
+	if transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != 100 || transport.MaxConnsPerHost != 0 {
+		t.Errorf("limits = %d/%d/%d, want the defaults", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+}
+
+func TestNormalizeBaseURL(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"http://db.example", "http://db.example/"},
+		{"https://db.example/api", "https://db.example/api/"},
+		{"https://db.example/api/", "https://db.example/api/"},
+		{"db.example", ""},
+		{"ftp://db.example", ""},
+		{"http://", ""},
+		{"http://db example", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeBaseURL(tt.raw)
+		if tt.want == "" && err == nil {
+			t.Errorf("NormalizeBaseURL(%q) = %q, want an error", tt.raw, got)
+		}
+		if tt.want != "" && (err != nil || got != tt.want) {
+			t.Errorf("NormalizeBaseURL(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, key := range []string{"db_client_cert", "db_client_key", "db_auth_mode", "db_fixture_json"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("sql_db_url", "http://a.example, https://b.example/api")
+	config, err := validateConfig()
+	if err != nil || !reflect.DeepEqual(config.DBURLs, []string{"http://a.example/", "https://b.example/api/"}) {
+		t.Errorf("validateConfig = %+v, %v", config, err)
+	}
+
+	var configErr *ConfigError
+	t.Setenv("sql_db_url", "")
+	if _, err := validateConfig(); !errors.As(err, &configErr) {
+		t.Errorf("validateConfig with no sql_db_url = %v, want a ConfigError", err)
+	}
+	t.Setenv("db_fixture_json", "fixture.json")
+	if config, err := validateConfig(); err != nil || len(config.DBURLs) != 0 {
+		t.Errorf("validateConfig with a fixture = %+v, %v", config, err)
+	}
+	t.Setenv("sql_db_url", "db.example")
+	if _, err := validateConfig(); !errors.As(err, &configErr) {
+		t.Errorf("validateConfig with a relative URL = %v, want a ConfigError", err)
+	}
+	t.Setenv("sql_db_url", "")
+	t.Setenv("db_auth_mode", "hmac")
+	if _, err := validateConfig(); !errors.As(err, &configErr) {
+		t.Errorf("validateConfig with a bad db_auth_mode = %v, want a ConfigError", err)
+	}
+}
+
+func TestRunWithAlert(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	t.Setenv("critical_recipients", "pager@example.com")
+	config := &Config{DBURLs: []string{db.BaseURL()}}
+
+	t.Setenv("report_sort", "bogus")
+	err := runWithAlert(context.Background(), config)
+	if category, _ := ErrorCategory(err); category != "config" {
+		t.Fatalf("err = %v (%s), want a config error", err, category)
+	}
+	alert := brevo.lastEmail(t)
+	if alert.Subject != "RSS Feed Health Check failed (config error)" || alert.To[0].Email != "pager@example.com" {
+		t.Errorf("alert = %q to %v", alert.Subject, alert.To)
+	}
+
+	t.Setenv("report_sort", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runWithAlert(ctx, config)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want it to wrap context.Canceled", err)
+	}
+	if n := len(brevo.sent()); n != 1 {
+		t.Errorf("sent %d emails, want no alert for a cancelled run", n)
+	}
+}
+
+func TestSendCriticalAlert(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	ctx := context.Background()
+	if err := SendCriticalAlert(ctx, httpClient, errors.New("boom")); err != nil || len(brevo.sent()) != 0 {
+		t.Errorf("SendCriticalAlert with no recipients = %v, sent %d", err, len(brevo.sent()))
+	}
+	t.Setenv("critical_recipients", "a@example.com, b@example.com")
+	if err := SendCriticalAlert(ctx, httpClient, &DBError{Err: errors.New("<down>")}); err != nil {
+		t.Fatal(err)
+	}
+	alert := brevo.lastEmail(t)
+	if alert.Subject != "RSS Feed Health Check failed (db error)" || len(alert.To) != 2 {
+		t.Errorf("alert = %q to %v", alert.Subject, alert.To)
+	}
+	if !strings.Contains(alert.HtmlContent, "&lt;down&gt;") {
+		t.Errorf("body = %q, want the escaped error", alert.HtmlContent)
+	}
+}
+
+func TestFormatThousands(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1,000"},
+		{1234567, "1,234,567"},
+		{-1234, "-1,234"},
+	}
+	for _, tt := range tests {
+		if got := FormatThousands(tt.n); got != tt.want {
+			t.Errorf("FormatThousands(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	db := newFakeDB(t, nil)
+	t.Setenv("feeds_file", "feeds.json")
+	t.Setenv("db_fixture_json", "")
+	config := &Config{DBURLs: []string{db.BaseURL()}}
+
+	checks := ValidationChecks(config)
+	var names []string
+	for _, check := range checks {
+		names = append(names, check.Name)
+	}
+	if want := []string{"db " + db.BaseURL(), "brevo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("checks = %v, want %v", names, want)
+	}
+	if !Validate(context.Background(), checks) {
+		t.Error("Validate failed against working fakes")
+	}
+	if got := db.queries()[0].Get("magazine"); got != "health-checker-validate" {
+		t.Errorf("DB check looked up %q", got)
+	}
+	if got := brevo.headers[0].Get("api-key"); got != "test-key" {
+		t.Errorf("Brevo check sent api-key %q", got)
+	}
+
+	brevo.Status = http.StatusUnauthorized
+	if Validate(context.Background(), checks) {
+		t.Error("Validate passed with Brevo rejecting the key")
+	}
+}
+
+func TestRunRecipientsFromCloudant(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	cloudant := newFakeCloudant(t)
+	t.Setenv("recipients_from_cloudant", "true")
+	t.Setenv("db_name", "config")
+
+	// Without the document, the configured recipients are used
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if to := brevo.lastEmail(t).To; len(to) != 2 || to[1].Email != "ops@example.com" {
+		t.Errorf("To = %v, want the configured recipients", to)
+	}
+
+	cloudant.put("config", map[string]interface{}{
+		"_id": "report_recipients",
+		"to":  []string{"team@example.com", "Team@example.com", "bad"},
+		"cc":  []string{"lead@example.com"},
+		"bcc": []string{},
+	})
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if want := []BrevoTo{{Email: "team@example.com"}}; !reflect.DeepEqual(email.To, want) {
+		t.Errorf("To = %v, want %v", email.To, want)
+	}
+	if want := []BrevoTo{{Email: "lead@example.com"}}; !reflect.DeepEqual(email.Cc, want) {
+		t.Errorf("Cc = %v, want %v", email.Cc, want)
+	}
+}
+
+func TestCloudantRecipientStore(t *testing.T) {
+	cloudant := newFakeCloudant(t)
+	store := &CloudantRecipientStore{Service: cloudant.service(t), DbName: "config", DocID: "recipients"}
+	recipients, err := store.GetRecipients(context.Background())
+	if recipients != nil || err != nil {
+		t.Errorf("GetRecipients with no document = %v, %v, want nil, nil", recipients, err)
+	}
+	cloudant.put("config", map[string]interface{}{"_id": "recipients", "to": []string{" a@example.com "}, "bcc": []string{"b@example.com"}})
+	recipients, err = store.GetRecipients(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, cc, bcc := recipients.Lists()
+	if len(to) != 1 || to[0].Email != "a@example.com" || cc != nil || len(bcc) != 1 {
+		t.Errorf("Lists = %v, %v, %v", to, cc, bcc)
+	}
+}
+
+func TestZeroAlertSuppressed(t *testing.T) {
+	runDate := time.Date(2024, 12, 25, 9, 0, 0, 0, time.UTC)
+	if ok, err := ZeroAlertSuppressed([]string{"2024-01-01", "2024-12-25"}, runDate); !ok || err != nil {
+		t.Errorf("ZeroAlertSuppressed on a listed date = %v, %v", ok, err)
+	}
+	if ok, err := ZeroAlertSuppressed([]string{"2024-01-01"}, runDate); ok || err != nil {
+		t.Errorf("ZeroAlertSuppressed on another date = %v, %v", ok, err)
+	}
+	if _, err := ZeroAlertSuppressed([]string{"12/25/2024"}, runDate); err == nil {
+		t.Error("ZeroAlertSuppressed with a bad date succeeded")
+	}
+}
+
+func TestBaselines(t *testing.T) {
+	history := []HistoryDoc{
+		{MagData: map[string]int{"A": 10, "B": 4}},
+		{MagData: map[string]int{"A": 12, "B": 4}},
+		{MagData: map[string]int{"A": 8}},
+	}
+	baselines := BaselineAverages(history, 3)
+	if !reflect.DeepEqual(baselines, map[string]float32{"A": 10}) {
+		t.Errorf("BaselineAverages = %v, want just A at 10", baselines)
+	}
+	drops := FindBaselineDrops(map[string]int{"A": 4, "C": 0}, []string{"A", "C"}, baselines, 0.5)
+	if want := []BaselineDrop{{Magazine: "A", Articles: 4, BaselineAvg: 10}}; !reflect.DeepEqual(drops, want) {
+		t.Errorf("FindBaselineDrops = %+v, want %+v", drops, want)
+	}
+	if drops := FindBaselineDrops(map[string]int{"A": 5}, []string{"A"}, baselines, 0.5); drops != nil {
+		t.Errorf("FindBaselineDrops at exactly the fraction = %+v", drops)
+	}
+}
+
+func TestFindNewFeeds(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 10, 9, 0, 0, 0, ny)
+	feeds := []Feed{
+		{FeedName: "recent", CreatedDate: "2024-03-08", LastUpdatedDate: "2024-03-01"},
+		{FeedName: "old", CreatedDate: "2024-03-01"},
+		{FeedName: "garbage", CreatedDate: "soon"},
+		{FeedName: "shown", DisplayName: "Shown", CreatedDate: "2024-03-10T08:00:00"},
+		{FeedName: "active", LastUpdatedDate: "2024-03-10"},
+	}
+	if got := FindNewFeeds(feeds, 3, now); !reflect.DeepEqual(got, map[string]bool{"recent": true, "Shown": true}) {
+		t.Errorf("FindNewFeeds = %v", got)
+	}
+}
+
+func TestRunCircuitBreaker(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B", "C"), nil)
+	db.Status = http.StatusInternalServerError
+	t.Setenv("max_concurrency", "1")
+	t.Setenv("db_breaker_failures", "1")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.queries()); n != 1 {
+		t.Errorf("made %d DB queries, want the breaker to stop after 1", n)
+	}
+	if body := brevo.lastEmail(t).HtmlContent; !strings.Contains(body, "Feeds failed: 3") {
+		t.Errorf("body = %q, want all 3 feeds failed", body)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var nilBreaker *CircuitBreaker
+	nilBreaker.Failure()
+	if nilBreaker.Open() {
+		t.Error("nil breaker opened")
+	}
+
+	breaker := &CircuitBreaker{Threshold: 2, Window: time.Minute}
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+	if breaker.Open() {
+		t.Error("breaker opened without consecutive failures")
+	}
+	breaker.Failure()
+	if !breaker.Open() {
+		t.Error("breaker didn't open after 2 consecutive failures")
+	}
+
+	breaker = &CircuitBreaker{Threshold: 2, Window: time.Millisecond}
+	breaker.Failure()
+	time.Sleep(5 * time.Millisecond)
+	breaker.Failure()
+	if breaker.Open() {
+		t.Error("breaker opened on failures outside the window")
+	}
+}
+
+func TestRunTemplate(t *testing.T) {
+	feeds := testFeeds("Old", "New")
+	feeds[0].LastUpdatedDate = time.Now().UTC().Format("2006-01-02")
+	feeds[1].CreatedDate = time.Now().UTC().Format("2006-01-02")
+	db, brevo := setupRun(t, feeds, map[string]int{})
+	t.Setenv("brevo_template_id", "7")
+	t.Setenv("new_feed_grace_days", "3")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if email.TemplateId != 7 || email.HtmlContent != "" {
+		t.Errorf("templateId = %d, htmlContent = %q", email.TemplateId, email.HtmlContent)
+	}
+	if zero := email.Params["zero_magazines"]; !reflect.DeepEqual(zero, []interface{}{"Old"}) {
+		t.Errorf("zero_magazines = %v, want just Old", zero)
+	}
+	if email.Params["zero_ingestion"] != 2.0 || email.Params["healthy"] != false {
+		t.Errorf("params = %v", email.Params)
+	}
+}
+
+func TestBrevoTemplateParams(t *testing.T) {
+	data := ReportData{ProgramName: "RSS", TotalArticles: 5, ZeroIngestion: 2}
+	allMagData := map[string]int{"A": 5, "B": 0, "C": 0}
+	params := BrevoTemplateParams(data, allMagData, []string{"B", "C", "A"}, nil, map[string]bool{"C": true})
+	if !reflect.DeepEqual(params["zero_magazines"], []string{"B"}) {
+		t.Errorf("zero_magazines = %v, want B", params["zero_magazines"])
+	}
+	if !reflect.DeepEqual(params["failed_magazines"], []string{}) {
+		t.Errorf("failed_magazines = %#v, want an empty list", params["failed_magazines"])
+	}
+
+	data.ZeroSuppressed = true
+	data.FailedFeeds = 1
+	params = BrevoTemplateParams(data, allMagData, []string{"B", "C", "A"}, []string{"D"}, nil)
+	if !reflect.DeepEqual(params["zero_magazines"], []string{}) || params["healthy"] != false {
+		t.Errorf("params = %v, want no zero magazines and unhealthy for the failure", params)
+	}
+}
+
+func TestRunAttachOnlyOnIssues(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B"), map[string]int{"A": 2, "B": 3})
+	newFakeCloudant(t)
+	t.Setenv("attach_only_on_issues", "true")
+	t.Setenv("persist_history", "true")
+	t.Setenv("weekly_report_day", time.Now().UTC().Weekday().String())
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if len(email.Attachment) != 0 {
+		t.Errorf("attached %d files on a healthy day, want none", len(email.Attachment))
+	}
+	if !strings.Contains(email.HtmlContent, "5 articles ingested across 2 magazines") {
+		t.Errorf("body = %q, want the summary", email.HtmlContent)
+	}
+	if strings.Contains(email.HtmlContent, "See attached") {
+		t.Errorf("body = %q, want no mention of an attachment", email.HtmlContent)
+	}
+
+	db.Counts["B"] = 0
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email = brevo.lastEmail(t)
+	var names []string
+	for _, attachment := range email.Attachment {
+		names = append(names, attachment.Name)
+	}
+	if len(names) != 2 || !strings.HasPrefix(names[0], "daily_article_data_") || !strings.HasPrefix(names[1], "weekly_article_trend_") {
+		t.Errorf("attachments = %v, want the report and weekly trend", names)
+	}
+	if !strings.Contains(email.HtmlContent, "See attached") {
+		t.Errorf("body = %q, want it to point at the attachment", email.HtmlContent)
+	}
+}
+
+func TestSummaryHTML(t *testing.T) {
+	html := SummaryHTML(ReportData{TotalArticles: 1234, TotalMagazines: 3, ZeroIngestion: 1})
+	if want := "<p>1,234 articles ingested across 3 magazines. 1 magazines with no articles, 0 failed DB lookups.</p>"; html != want {
+		t.Errorf("SummaryHTML = %q, want %q", html, want)
+	}
+}
+
+func TestRunUsesIngestRange(t *testing.T) {
+	db, _ := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	t.Setenv("db_use_range", "true")
+	t.Setenv("ingest_date", "2024-03-05")
+	t.Setenv("ingest_window", "36h")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	query := db.queries()[0]
+	if query.Get("start") != "2024-03-05T00:00:00Z" || query.Get("end") != "2024-03-06T12:00:00Z" || query.Get("ingestdate") != "2024-3-5" {
+		t.Errorf("query = %v, want the 36h window from the ingest date", query)
+	}
+}
+
+func TestDBQueryParams(t *testing.T) {
+	t.Setenv("sql_db_apikey", "secret")
+	date := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	params := DBQueryParams("Mag, A", date)
+	if params.Get("apikey") != "secret" || params.Get("ingestdate") != "2024-3-5" || params.Get("magazine") != "Mag, A" {
+		t.Errorf("params = %v", params)
+	}
+
+	params = DBBatchQueryParams([]string{"A", "B"}, date)
+	if params.Get("magazines") != "A,B" || params.Has("magazine") {
+		t.Errorf("batch params = %v", params)
+	}
+
+	AddIngestRange(params, date, date.Add(24*time.Hour))
+	if params.Get("start") != "2024-03-05T12:00:00Z" || params.Get("end") != "2024-03-06T12:00:00Z" {
+		t.Errorf("range params = %v", params)
+	}
+
+	t.Setenv("db_auth_mode", "header")
+	if params := DBQueryParams("A", date); params.Has("apikey") {
+		t.Errorf("params = %v, want no apikey in header mode", params)
+	}
+}
+
+func TestFooterHTML(t *testing.T) {
+	footer := FooterHTML(5, []string{"A&B"}, "run-1")
+	if !strings.Contains(footer, "Feeds checked: 5. Feeds failed: 1 (A&amp;B).<br>Run ID: run-1") {
+		t.Errorf("FooterHTML = %q", footer)
+	}
+	many := make([]string, maxFooterFailures+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("M%d", i)
+	}
+	if footer := FooterHTML(20, many, "run-1"); !strings.Contains(footer, "Feeds failed: 11.<br>") {
+		t.Errorf("FooterHTML with many failures = %q, want just the count", footer)
+	}
+}
+
+func TestRunRetryFailedFeeds(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B"), map[string]int{"A": 1, "B": 2})
+	db.Broken = map[string]bool{"B": true}
+	failedFile := filepath.Join(t.TempDir(), "failed.json")
+	t.Setenv("failed_feeds_file", failedFile)
+	t.Setenv("ingest_date", "2024-03-05")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := LoadFailedFeeds(failedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.IngestDate != "2024-03-05" || !reflect.DeepEqual(failed.Magazines, []string{"B"}) || failed.RunID != runID {
+		t.Errorf("failed feeds = %+v", failed)
+	}
+
+	db.Broken = nil
+	firstRun := len(db.queries())
+	t.Setenv("ingest_date", "")
+	t.Setenv("failed_feeds_file", "")
+	t.Setenv("retry_failed_from", failedFile)
+	t.Setenv("db_use_range", "true")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	queries := db.queries()[firstRun:]
+	if len(queries) != 1 || queries[0].Get("magazine") != "B" {
+		t.Fatalf("rerun queries = %v, want just B", queries)
+	}
+	if queries[0].Get("start") != "2024-03-05T00:00:00Z" || queries[0].Get("end") != "2024-03-06T00:00:00Z" {
+		t.Errorf("rerun query = %v, want the failed run's day", queries[0])
+	}
+	email := brevo.lastEmail(t)
+	if !strings.HasPrefix(email.Subject, "Supplemental: ") {
+		t.Errorf("subject = %q, want it marked supplemental", email.Subject)
+	}
+	if rows := attachmentRows(t, email.Attachment[0]); findRow(rows, "B") == nil || findRow(rows, "A") != nil {
+		t.Errorf("rows = %v, want just B", rows)
+	}
+}
+
+func TestFailedFeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.json")
+	if err := SaveFailedFeeds(path, FailedFeedsData{RunID: "r1", IngestDate: "2024-03-05"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); !strings.Contains(string(b), `"magazines":[]`) {
+		t.Errorf("saved %s, want an empty magazines list", b)
+	}
+	if _, err := LoadFailedFeeds(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadFailedFeeds of a missing file succeeded")
+	}
+
+	feeds := []Feed{{FeedName: "a"}, {FeedName: "b", DisplayName: "B"}, {FeedName: "c"}}
+	if got := OnlyFeeds(feeds, []string{"a", "B"}); len(got) != 2 || got[1].FeedName != "b" {
+		t.Errorf("OnlyFeeds = %v, want a and b", got)
+	}
+}
+
+func TestWithDBAuth(t *testing.T) {
+	var header http.Header
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, query = r.Header, r.URL.Query()
+		fmt.Fprint(w, "[]")
+	}))
+	defer srv.Close()
+	t.Setenv("sql_db_apikey", "secret")
+
+	if err := CheckDB(context.Background(), srv.Client(), srv.URL+"/articles"); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("apikey") != "secret" || header.Get("X-API-Key") != "" {
+		t.Errorf("query mode sent apikey %q, header %q", query.Get("apikey"), header.Get("X-API-Key"))
+	}
+
+	t.Setenv("db_auth_mode", "header")
+	if err := CheckDB(context.Background(), srv.Client(), srv.URL+"/articles"); err != nil {
+		t.Fatal(err)
+	}
+	if query.Has("apikey") || header.Get("X-API-Key") != "secret" {
+		t.Errorf("header mode sent apikey %q, header %q", query.Get("apikey"), header.Get("X-API-Key"))
+	}
+
+	t.Setenv("db_auth_header", "Authorization-Key")
+	client := WithDBAuth(&http.Client{Timeout: time.Minute})
+	if client.Timeout != time.Minute {
+		t.Errorf("timeout = %s, want it kept", client.Timeout)
+	}
+	if _, err := client.Get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization-Key") != "secret" {
+		t.Errorf("headers = %v, want Authorization-Key", header)
+	}
+}
+
+func TestCloudantFeedStoreErrors(t *testing.T) {
+	cloudant := newFakeCloudant(t)
+	store := &CloudantFeedStore{Service: cloudant.service(t), DbName: "publishers", Timeout: 50 * time.Millisecond}
+
+	cloudant.SetDelay(2 * time.Second)
+	_, err := store.GetFeeds(context.Background())
+	var cloudantErr *CloudantError
+	if !errors.As(err, &cloudantErr) || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("err = %v, want a Cloudant timeout", err)
+	}
+
+	cloudant.SetDelay(0)
+	cloudant.SetStatus(http.StatusUnauthorized)
+	_, err = store.GetFeeds(context.Background())
+	var nonRetryable *NonRetryableError
+	if !errors.As(err, &nonRetryable) {
+		t.Errorf("err = %v, want a NonRetryableError for a 401", err)
+	}
+
+	cloudant.SetStatus(http.StatusServiceUnavailable)
+	_, err = store.GetFeeds(context.Background())
+	if err == nil || errors.As(err, &nonRetryable) {
+		t.Errorf("err = %v, want a retryable error for a 503", err)
+	}
+}
+
+func TestDecodeDBResponse(t *testing.T) {
+	rows, count, err := DecodeDBResponse(strings.NewReader(`[{"id": 1}, {"id": 2}]`), "rows")
+	if err != nil || len(rows) != 2 || count != 2 {
+		t.Errorf("rows mode = %v, %d, %v", rows, count, err)
+	}
+	rows, count, err = DecodeDBResponse(strings.NewReader(`{"total_count": 250, "articles": [{"id": 1}]}`), "field")
+	if err != nil || len(rows) != 1 || count != 250 {
+		t.Errorf("field mode = %v, %d, %v", rows, count, err)
+	}
+	if _, _, err := DecodeDBResponse(strings.NewReader(`{"total_count": 1}`), "rows"); err == nil {
+		t.Error("rows mode decoded an object")
+	}
+}
+
+func TestFetchArticles(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Query().Get("magazine") {
+		case "flaky":
+			if calls == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"total_count": 40, "articles": [{"id": 1}]}`)
+		case "broken":
+			fmt.Fprint(w, "<html>")
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	rows, count, attempts, err := FetchArticles(ctx, srv.Client(), nil, "field", 0, srv.URL+"?magazine=flaky")
+	if err != nil || len(rows) != 1 || count != 40 || attempts != 2 {
+		t.Errorf("FetchArticles = %d rows, %d, %d attempts, %v", len(rows), count, attempts, err)
+	}
+
+	calls = 0
+	_, _, attempts, err = FetchArticles(ctx, srv.Client(), nil, "rows", 0, srv.URL+"?magazine=broken")
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) || attempts != 1 {
+		t.Errorf("FetchArticles = %d attempts, %v, want a DBError without retrying", attempts, err)
+	}
+
+	breaker := &CircuitBreaker{Threshold: 1, Window: time.Minute}
+	breaker.Failure()
+	calls = 0
+	_, _, attempts, err = FetchArticles(ctx, srv.Client(), breaker, "rows", 0, srv.URL+"?magazine=flaky")
+	if err != ErrDBUnavailable || attempts != 0 || calls != 0 {
+		t.Errorf("FetchArticles = %d attempts, %v, want ErrDBUnavailable without a request", attempts, err)
+	}
+}
+
+func TestRunOversizedAttachments(t *testing.T) {
+	var names []string
+	counts := map[string]int{}
+	for i := 1; i <= 30; i++ {
+		name := fmt.Sprintf("Magazine %02d", i)
+		names = append(names, name)
+		counts[name] = i
+	}
+	db, brevo := setupRun(t, testFeeds(names...), counts)
+	t.Setenv("max_attachment_bytes", "200")
+	t.Setenv("attachment_truncate_rows", "3")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email := brevo.lastEmail(t)
+	if len(email.Attachment) != 1 || !strings.HasSuffix(email.Attachment[0].Name, "_truncated.csv") {
+		t.Fatalf("attachments = %v, want the truncated CSV", email.Attachment)
+	}
+	rows := attachmentRows(t, email.Attachment[0])
+	if len(rows) != 6 || rows[1][0] != "Magazine 01" || rows[3][0] != "Magazine 03" {
+		t.Errorf("rows = %v, want the 3 smallest magazines", rows)
+	}
+	if !strings.Contains(email.HtmlContent, "only the 3 magazines with the fewest articles") {
+		t.Errorf("body = %q, want the truncation note", email.HtmlContent)
+	}
+
+	t.Setenv("max_attachment_bytes", "1")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	email = brevo.lastEmail(t)
+	if len(email.Attachment) != 0 || !strings.Contains(email.HtmlContent, "The report was too large to attach.") {
+		t.Errorf("attachments = %d, body = %q, want none and a note", len(email.Attachment), email.HtmlContent)
+	}
+}
+
+func TestTruncateReport(t *testing.T) {
+	report := Report{
+		MagData:       map[string]int{"A": 5, "B": 0, "C": 3, "D": 1},
+		Keys:          []string{"A", "B", "C", "D"},
+		StaleFeeds:    []StaleFeed{{FeedName: "A"}},
+		MalformedDocs: []MalformedDoc{{DocID: "x"}},
+	}
+	truncated := TruncateReport(report, 2)
+	if !reflect.DeepEqual(truncated.Keys, []string{"B", "D"}) || truncated.StaleFeeds != nil || truncated.MalformedDocs != nil {
+		t.Errorf("TruncateReport = %+v", truncated)
+	}
+	if got := TruncateReport(report, 4); !reflect.DeepEqual(got, report) {
+		t.Errorf("TruncateReport with room for everything = %+v, want it unchanged", got)
+	}
+	if size := AttachmentsSize([]BrevoAttachment{{Content: "abcd"}, {Content: "ef"}}); size != 6 {
+		t.Errorf("AttachmentsSize = %d, want 6", size)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	var nilLimiter *RateLimiter
+	if err := nilLimiter.Wait(ctx, "a.example"); err != nil {
+		t.Errorf("nil limiter Wait = %v", err)
+	}
+
+	limiter := NewRateLimiter(0, 100*time.Millisecond)
+	start := time.Now()
+	limiter.Wait(ctx, "a.example")
+	limiter.Wait(ctx, "b.example")
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("different hosts waited %s", elapsed)
+	}
+	limiter.Wait(ctx, "a.example")
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("same host only waited %s", elapsed)
+	}
+
+	limiter = NewRateLimiter(20, 0)
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Wait(ctx, "")
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests at 20 rps took %s, want at least 100ms", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	limiter = NewRateLimiter(0, time.Hour)
+	limiter.Wait(ctx, "a.example")
+	if err := limiter.Wait(cancelled, "a.example"); err == nil {
+		t.Error("Wait with a cancelled context succeeded")
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err      error
+		category string
+		code     int
+	}{
+		{configErrorf("bad"), "config", 2},
+		{&CloudantError{Err: errors.New("down")}, "cloudant", 3},
+		{fmt.Errorf("loading: %w", &CloudantError{Err: &NonRetryableError{Err: errors.New("401")}}), "cloudant", 3},
+		{&DBError{Err: errors.New("down")}, "db", 4},
+		{fmt.Errorf("sending: %w", &BrevoError{Err: errors.New("400")}), "brevo", 5},
+		{errors.New("other"), "other", 1},
+	}
+	for _, tt := range tests {
+		if category, code := ErrorCategory(tt.err); category != tt.category || code != tt.code {
+			t.Errorf("ErrorCategory(%v) = %s, %d, want %s, %d", tt.err, category, code, tt.category, tt.code)
+		}
+	}
+}
+
+func TestRunUploadsToStorage(t *testing.T) {
+	var puts []string
+	var body []byte
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts = append(puts, r.Method+" "+r.URL.EscapedPath())
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer storage.Close()
+	db, brevo := setupRun(t, testFeeds("A"), map[string]int{"A": 1})
+	t.Setenv("output_storage_url", storage.URL+"/bucket")
+	t.Setenv("output_storage_only", "true")
+	t.Setenv("ingest_date", "2024-03-05")
+	t.Setenv("attachment_name_template", "report {{.TotalArticles}}")
+	t.Setenv("emit_summary", "true")
+	var runErr error
+	output := captureStdout(t, func() { runErr = runAgainst(db) })
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	wantPath := "/bucket/daily_article_data/2024-03-05/report%201.csv"
+	if !reflect.DeepEqual(puts, []string{"PUT " + wantPath}) {
+		t.Errorf("uploads = %v, want %s", puts, wantPath)
+	}
+	if findRow(csvRows(t, body), "A") == nil {
+		t.Errorf("uploaded %q, want the CSV", body)
+	}
+	if summary := summaryLine(t, output); !reflect.DeepEqual(summary.ReportURLs, []string{storage.URL + wantPath}) {
+		t.Errorf("report_urls = %v", summary.ReportURLs)
+	}
+	if n := len(brevo.sent()); n != 0 {
+		t.Errorf("sent %d emails, want none with output_storage_only", n)
+	}
+}
+
+func TestS3Uploader(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	uploader := &S3Uploader{BaseURL: srv.URL + "/bucket/", Region: "eu-west-1", AccessKey: "AKID", SecretKey: "secret", Client: srv.Client()}
+
+	objectURL, err := uploader.Upload(context.Background(), "reports/a b+c.csv", []byte("x,y\n"), "text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/bucket/reports/a%20b%2Bc.csv"; objectURL != want {
+		t.Errorf("URL = %q, want %q", objectURL, want)
+	}
+	if req.Method != "PUT" || string(body) != "x,y\n" || req.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("request = %s %q %q", req.Method, body, req.Header.Get("Content-Type"))
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") != sha256Hex([]byte("x,y\n")) {
+		t.Errorf("X-Amz-Content-Sha256 = %q", req.Header.Get("X-Amz-Content-Sha256"))
+	}
+	date := req.Header.Get("X-Amz-Date")
+	wantAuth := "AWS4-HMAC-SHA256 Credential=AKID/" + date[:8] + "/eu-west-1/s3/aws4_request, SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, Signature="
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, wantAuth) || len(auth) != len(wantAuth)+64 {
+		t.Errorf("Authorization = %q", auth)
+	}
+
+	status = http.StatusForbidden
+	if _, err := uploader.Upload(context.Background(), "a.csv", nil, "text/csv"); err == nil {
+		t.Error("Upload succeeded on a 403")
+	}
+}
+
+func TestAWSURIEscape(t *testing.T) {
+	tests := map[string]string{
+		"abc-_.~XYZ09": "abc-_.~XYZ09",
+		"a b":          "a%20b",
+		"a+b/c":        "a%2Bb%2Fc",
+		"é":            "%C3%A9",
+	}
+	for in, want := range tests {
+		if got := awsURIEscape(in); got != want {
+			t.Errorf("awsURIEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStreaks(t *testing.T) {
+	now := time.Date(2024, 3, 5, 6, 0, 0, 0, time.UTC)
+	streaks := map[string]FeedStreak{
+		"A": {FailureStreak: 4},
+		"B": {FailureStreak: 1, LastSuccess: "2024-03-01T06:00:00Z"},
+		"C": {FailureStreak: 2},
+	}
+	streaks = UpdateStreaks(streaks, map[string]int{"A": 0}, []string{"B", "C", "D"}, now)
+	if streaks["A"] != (FeedStreak{LastSuccess: "2024-03-05T06:00:00Z"}) {
+		t.Errorf("A = %+v, want the streak reset", streaks["A"])
+	}
+	if streaks["B"].FailureStreak != 2 || streaks["B"].LastSuccess != "2024-03-01T06:00:00Z" || streaks["D"].FailureStreak != 1 {
+		t.Errorf("streaks = %+v", streaks)
+	}
+	fails := FindPersistentFailures(streaks, 2)
+	want := []PersistentFailure{
+		{Magazine: "C", FailureStreak: 3},
+		{Magazine: "B", FailureStreak: 2, LastSuccess: "2024-03-01T06:00:00Z"},
+	}
+	if !reflect.DeepEqual(fails, want) {
+		t.Errorf("FindPersistentFailures = %+v, want %+v", fails, want)
+	}
+	if streaks := UpdateStreaks(nil, nil, []string{"A"}, now); streaks["A"].FailureStreak != 1 {
+		t.Errorf("UpdateStreaks(nil) = %+v", streaks)
+	}
+}
+
+func TestWriteJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteJSONL(&buf, []FeedResult{
+		{Magazine: "B", Publisher: "Pub", IngestedArticles: 2},
+		{Magazine: "A", Publisher: "Pub", Err: errors.New("timeout")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"magazine":"A","articles":0,"publisher":"Pub","failed":true,"error":"timeout"}` + "\n" +
+		`{"magazine":"B","articles":2,"publisher":"Pub","failed":false}` + "\n"
+	if buf.String() != want {
+		t.Errorf("WriteJSONL = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestDBClientCert(t *testing.T) {
+	certPEM, keyPEM := newTestCert(t)
+	var commonName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+		fmt.Fprint(w, "[]")
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Setenv("db_client_cert", string(certPEM))
+	t.Setenv("db_client_key", string(keyPEM))
+	cert, err := LoadDBClientCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckDB(context.Background(), WithClientCert(srv.Client(), cert), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if commonName != "health-checker" {
+		t.Errorf("server saw client cert %q", commonName)
+	}
+	if err := CheckDB(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("CheckDB without a client cert succeeded")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "client.crt"), certPEM, 0600)
+	os.WriteFile(filepath.Join(dir, "client.key"), keyPEM, 0600)
+	t.Setenv("db_client_cert", filepath.Join(dir, "client.crt"))
+	t.Setenv("db_client_key", filepath.Join(dir, "client.key"))
+	if cert, err := LoadDBClientCert(); err != nil || cert == nil {
+		t.Errorf("LoadDBClientCert from files = %v, %v", cert, err)
+	}
+
+	t.Setenv("db_client_key", "")
+	if _, err := LoadDBClientCert(); err == nil {
+		t.Error("LoadDBClientCert with only a cert succeeded")
+	}
+	t.Setenv("db_client_cert", "")
+	if cert, err := LoadDBClientCert(); cert != nil || err != nil {
+		t.Errorf("LoadDBClientCert with neither = %v, %v, want nil, nil", cert, err)
+	}
+	t.Setenv("db_client_cert", string(certPEM))
+	t.Setenv("db_client_key", string(certPEM))
+	if _, err := LoadDBClientCert(); err == nil {
+		t.Error("LoadDBClientCert with a mismatched key succeeded")
+	}
+}
+
+func TestRunBatchesDBLookups(t *testing.T) {
+	db, brevo := setupRun(t, testFeeds("A", "B", "C, Inc"), map[string]int{"A": 2, "B": 1, "C, Inc": 4})
+	db.Omit = map[string]bool{"B": true}
+	t.Setenv("db_supports_batch", "true")
+	t.Setenv("db_batch_size", "10")
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var batched, single []string
+	for _, query := range db.queries() {
+		if query.Has("magazines") {
+			batched = append(batched, query.Get("magazines"))
+		} else {
+			single = append(single, query.Get("magazine"))
+		}
+	}
+	if !reflect.DeepEqual(batched, []string{"A,B"}) || !reflect.DeepEqual(single, []string{"C, Inc"}) {
+		t.Errorf("batched %v, single %v, want A,B batched and C, Inc alone", batched, single)
+	}
+
+	email := brevo.lastEmail(t)
+	rows := attachmentRows(t, email.Attachment[0])
+	if findRow(rows, "A")[1] != "2" || findRow(rows, "C, Inc")[1] != "4" || findRow(rows, "B") != nil {
+		t.Errorf("rows = %v, want A and C, Inc but not B", rows)
+	}
+	if !strings.Contains(email.HtmlContent, "Feeds failed: 1 (B)") {
+		t.Errorf("body = %q, want B failed", email.HtmlContent)
+	}
+}
+
+func TestRunBatchesWithFixture(t *testing.T) {
+	brevo := newFakeBrevo(t)
+	t.Setenv("feeds_file", writeJSONFile(t, "feeds.json", testFeeds("A", "B", "C")))
+	t.Setenv("db_fixture_json", writeJSONFile(t, "fixture.json", map[string]int{"A": 3, "B": 1, "C": 0}))
+	t.Setenv("email_address", "ops@example.com")
+	t.Setenv("db_supports_batch", "true")
+	t.Setenv("db_batch_size", "2")
+	if err := run(context.Background(), &Config{}); err != nil {
+		t.Fatal(err)
+	}
+	rows := attachmentRows(t, brevo.lastEmail(t).Attachment[0])
+	if got := findRow(rows, "TOTAL"); got[1] != "4" {
+		t.Errorf("TOTAL = %v, want 4", got)
+	}
+}
+
+func TestDecodeDBBatchResponse(t *testing.T) {
+	rows, counts, err := DecodeDBBatchResponse(strings.NewReader(`{"A": [{"id": 1}], "B": []}`), "rows")
+	if err != nil || len(rows["A"]) != 1 || counts["A"] != 1 || counts["B"] != 0 {
+		t.Errorf("rows mode = %v, %v, %v", rows, counts, err)
+	}
+	_, counts, err = DecodeDBBatchResponse(strings.NewReader(`{"A": {"total_count": 40, "articles": []}}`), "field")
+	if err != nil || counts["A"] != 40 {
+		t.Errorf("field mode = %v, %v", counts, err)
+	}
+	_, _, err = DecodeDBBatchResponse(strings.NewReader(`{"A": {"id": 1}}`), "rows")
+	if err == nil || !strings.Contains(err.Error(), `"A"`) {
+		t.Errorf("err = %v, want it to name the magazine", err)
+	}
+}
+
+func TestSplitBatchable(t *testing.T) {
+	batchable, single := SplitBatchable(testFeeds("A", "B, Inc", "C"))
+	if len(batchable) != 2 || len(single) != 1 || single[0].FeedName != "B, Inc" {
+		t.Errorf("SplitBatchable = %v, %v", batchable, single)
+	}
+}
+
+func TestRunMalformedDocs(t *testing.T) {
+	db, brevo := setupRun(t, nil, map[string]int{"A": 1})
+	t.Setenv("feeds_file", writeJSONFile(t, "docs.json", []map[string]interface{}{
+		{"_id": "good", "Publisher_Name": "Pub", "RSS_Feeds": []map[string]string{{"RSS_Feed_Name": "A"}}},
+		{"_id": "bad", "Publisher_Name": "Pub", "RSS_Feeds": "oops"},
+	}))
+	if err := runAgainst(db); err != nil {
+		t.Fatal(err)
+	}
+	rows := attachmentRows(t, brevo.lastEmail(t).Attachment[0])
+	if findRow(rows, "malformed_document") == nil || findRow(rows, "bad") == nil {
+		t.Errorf("rows = %v, want the malformed document section", rows)
+	}
+}
+
+func TestBuildCSVSections(t *testing.T) {
+	var buf bytes.Buffer
+	err := BuildCSV(&buf, Report{
+		MagData:            map[string]int{"A": 1},
+		Keys:               []string{"A"},
+		StaleFeeds:         []StaleFeed{{FeedName: "Old", Publisher: "Pub", LastUpdatedDate: "garbage", AgeDays: -1}},
+		BelowExpected:      []BelowExpected{{Magazine: "A", Articles: 1, MinArticles: 5}},
+		BaselineDrops:      []BaselineDrop{{Magazine: "A", Articles: 1, BaselineAvg: 10}},
+		PersistentFailures: []PersistentFailure{{Magazine: "B", FailureStreak: 3}},
+		MalformedDocs:      []MalformedDoc{{DocID: "doc1", Error: "bad"}},
+		UnhealthyFeeds:     []FeedStatus{{FeedName: "A", FeedUrl: "https://a.example", StatusCode: 404}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := csvRows(t, buf.Bytes())
+	for _, want := range [][]string{
+		{"Old", "Pub", "garbage", "unknown"},
+		{"A", "1", "5", "below expected"},
+		{"A", "1", "10.0"},
+		{"B", "3", ""},
+		{"doc1", "bad"},
+		{"A", "https://a.example", "http 404"},
+	} {
+		found := false
+		for _, row := range rows {
+			if reflect.DeepEqual(row, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("rows = %v, missing %v", rows, want)
+		}
+	}
+}